@@ -4,17 +4,12 @@ go 1.14
 
 require (
 	github.com/fasthttp/router v1.4.0
-	github.com/gofrs/uuid v3.3.0+incompatible // indirect
-	github.com/jackc/fake v0.0.0-20150926172116-812a484cc733 // indirect
-	github.com/jackc/pgmock v0.0.0-20201204152224-4fe30f7445fd // indirect
-	github.com/jackc/pgtype v1.6.2
-	github.com/jackc/pgx v3.6.2+incompatible
+	github.com/jackc/pgconn v1.14.3
+	github.com/jackc/pgtype v1.14.0
+	github.com/jackc/pgx/v4 v4.18.3
 	github.com/kr/text v0.2.0 // indirect
-	github.com/lib/pq v1.9.0 // indirect
+	github.com/mailru/easyjson v0.7.7
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/shopspring/decimal v1.2.0 // indirect
-	github.com/stretchr/testify v1.6.1 // indirect
 	github.com/valyala/fasthttp v1.27.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776 // indirect
 )
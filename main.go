@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"forum_dbms/models"
 	"forum_dbms/server"
 	"github.com/fasthttp/router"
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/valyala/fasthttp"
 	"log"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -24,57 +30,330 @@ func loggerMid(req fasthttp.RequestHandler) fasthttp.RequestHandler {
 	})
 }
 
-func runServer(addr string) {
-	connString := "host=localhost user=docker password=docker dbname=forum_db sslmode=disable"
-	pgxConn, err := pgx.ParseConnectionString(connString)
+// Connection pool settings, see the db-* flags.
+var (
+	dbMaxConns          = 100
+	dbMaxConnLifetime   = time.Hour
+	dbMaxConnIdleTime   = 30 * time.Minute
+	dbHealthCheckPeriod = time.Minute
+)
+
+// replicaList collects every -replica flag.
+type replicaList []string
+
+func (r *replicaList) String() string {
+	return strings.Join(*r, ", ")
+}
+
+func (r *replicaList) Set(connString string) error {
+	*r = append(*r, connString)
+	return nil
+}
+
+var replicaConnStrings replicaList
+
+func connectDB() error {
+	var err error
+	models.DB, err = connectPool("host=localhost user=docker password=docker dbname=forum_db sslmode=disable")
 	if err != nil {
-		return
+		return err
 	}
 
-	pgxConn.PreferSimpleProtocol = true
+	var replicas []*pgxpool.Pool
+	for _, connString := range replicaConnStrings {
+		replica, err := connectPool(connString)
+		if err != nil {
+			return err
+		}
+		replicas = append(replicas, replica)
+	}
+	server.UseReplicas(replicas)
+	return nil
+}
 
-	config := pgx.ConnPoolConfig{
-		ConnConfig:     pgxConn,
-		MaxConnections: 100,
-		AfterConnect:   nil,
-		AcquireTimeout: 0,
+func connectPool(connString string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
 	}
 
-	models.DB, err = pgx.NewConnPool(config)
+	config.MaxConns = int32(dbMaxConns)
+	config.MaxConnLifetime = dbMaxConnLifetime
+	config.MaxConnIdleTime = dbMaxConnIdleTime
+	config.HealthCheckPeriod = dbHealthCheckPeriod
+
+	// Without prepared statements every query is sent as plain text.
+	if server.PreparedStatements {
+		config.AfterConnect = server.PrepareStatements
+	} else {
+		config.ConnConfig.PreferSimpleProtocol = true
+	}
+
+	return pgxpool.ConnectConfig(context.Background(), config)
+}
+
+func runServer(addr string) {
+	go server.RunWebhookWorker()
+	go server.RunCacheListener()
+	go server.RunIdempotencyCleanup()
+	go server.RunRateLimitCleanup()
+	go server.RunReplicaMonitor()
+	go server.RunTrendingRefresher()
 
-	
 	router := router.New()
+	router.SaveMatchedRoutePath = true
+
+	read := func(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return server.LimitBody(server.MaxBodySize, server.Limit(server.ReadLimit, handler))
+	}
+	write := func(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return server.LimitBody(server.MaxBodySize, server.Limit(server.WriteLimit, handler))
+	}
+	service := func(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return server.LimitBody(server.MaxBodySize, handler)
+	}
+	bulk := func(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return server.LimitStream(server.MaxStreamBodySize, handler)
+	}
 
 	prefix := "/api"
-	router.POST(prefix+"/user/{username}/create", server.CreateUser)
-	router.GET(prefix+"/user/{username}/profile", server.GetUserProfile)
-	router.POST(prefix+"/user/{username}/profile", server.EditUser)
+	router.POST(prefix+"/user/{username}/create", write(server.Idempotent(fasthttp.StatusCreated, server.CreateUser)))
+	router.GET(prefix+"/user/{username}/profile", read(server.GetUserProfile))
+	router.POST(prefix+"/user/{username}/profile", write(server.EditUser))
+	router.GET(prefix+"/users", read(server.ListUsers))
+	router.GET(prefix+"/user/{username}/threads", read(server.UserThreads))
+	router.GET(prefix+"/user/{username}/posts", read(server.UserPosts))
+	router.GET(prefix+"/user/{username}/forums", read(server.UserForums))
+
+	router.POST(prefix+"/forum/create", write(server.Idempotent(fasthttp.StatusCreated, server.CreateForum)))
+	router.GET(prefix+"/forums", read(server.ListForums))
+	router.GET(prefix+"/forum/{forumname}/details", read(server.ForumDetails))
+	router.GET(prefix+"/forum/{forumname}/users", read(server.ForumUsers))
+	router.GET(prefix+"/forum/{forumname}/threads", read(server.ForumThreads))
+	router.GET(prefix+"/forum/{forumname}/trending", read(server.ForumTrending))
+	router.POST(prefix+"/forum/{forumname}/webhooks", write(server.CreateWebhook))
+	router.GET(prefix+"/forum/{forumname}/webhooks", read(server.ForumWebhooks))
+	router.GET(prefix+"/forum/{forumname}/webhooks/deliveries", read(server.WebhookDeliveries))
 
-	router.POST(prefix+"/forum/create", server.CreateForum)
-	router.GET(prefix+"/forum/{forumname}/details", server.ForumDetails)
-	router.GET(prefix+"/forum/{forumname}/users", server.ForumUsers)
-	router.GET(prefix+"/forum/{forumname}/threads", server.ForumThreads)
+	router.POST(prefix+"/forum/{forumname}/create", write(server.Idempotent(fasthttp.StatusCreated, server.CreateThread)))
+	router.GET(prefix+"/thread/{threadnameOrID}/details", read(server.GetThreadDetails))
+	router.POST(prefix+"/thread/{threadnameOrID}/details", write(server.EditThread))
+	router.GET(prefix+"/thread/{threadnameOrID}/posts", read(server.ThreadPosts))
+	router.POST(prefix+"/thread/{threadnameOrID}/vote", write(server.Idempotent(fasthttp.StatusOK, server.VoteThread)))
 
-	router.POST(prefix+"/forum/{forumname}/create", server.CreateThread)
-	router.GET(prefix+"/thread/{threadnameOrID}/details", server.GetThreadDetails)
-	router.POST(prefix+"/thread/{threadnameOrID}/details", server.EditThread)
-	router.GET(prefix+"/thread/{threadnameOrID}/posts", server.ThreadPosts)
-	router.POST(prefix+"/thread/{threadnameOrID}/vote", server.VoteThread)
+	router.POST(prefix+"/thread/{threadnameOrID}/create", write(server.Idempotent(fasthttp.StatusCreated, server.CreatePosts)))
+	router.GET(prefix+"/post/{postID}/details", read(server.GetPostDetails))
+	router.POST(prefix+"/post/{postID}/details", write(server.EditPostDetails))
+	router.GET(prefix+"/post/{postID}/replies", read(server.PostReplies))
+	router.GET(prefix+"/post/{postID}/context", read(server.PostContext))
 
-	router.POST(prefix+"/thread/{threadnameOrID}/create", server.CreatePosts)
-	router.GET(prefix+"/post/{postID}/details", server.GetPostDetails)
-	router.POST(prefix+"/post/{postID}/details", server.EditPostDetails)
+	router.GET(prefix+"/service/status", service(server.StatusHandler))
+	router.POST(prefix+"/service/clear", service(server.ClearHandler))
+	router.GET(prefix+"/service/cache", service(server.CacheStatsHandler))
+	router.GET(prefix+"/service/pool", service(server.PoolStatsHandler))
 
-	router.GET(prefix+"/service/status", server.StatusHandler)
-	router.POST(prefix+"/service/clear", server.ClearHandler)
+	router.GET(prefix+"/trending", read(server.SiteTrending))
+	router.GET(prefix+"/events", read(server.EventsHandler))
+	router.POST(prefix+"/service/import", bulk(server.ImportHandler))
+	router.GET(prefix+"/service/export", service(server.ExportHandler))
+	router.POST(prefix+"/service/restore", bulk(server.RestoreHandler))
+	router.GET(prefix+"/forum/{forumname}/export", read(server.ExportForumHandler))
 
 	fmt.Printf("Starting server at localhost%s\n", addr)
-	err = fasthttp.ListenAndServe(addr, loggerMid(router.Handler))
+	// Bodies are streamed so that import and restore read theirs as they
+	// arrive, capped by LimitStream. Every other route caps its body in
+	// LimitBody.
+	httpServer := fasthttp.Server{
+		Handler:           loggerMid(router.Handler),
+		ErrorHandler:      server.RequestErrorHandler,
+		StreamRequestBody: true,
+	}
+	err := httpServer.ListenAndServe(addr)
 	if err != nil {
 		return
 	}
 }
 
+func runImport(job, path string) {
+	input := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	report, err := server.ImportNDJSON(context.Background(), job, input)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(body))
+}
+
+func runExport(forum string) {
+	output := bufio.NewWriter(os.Stdout)
+	err := server.ExportNDJSON(context.Background(), forum, output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = output.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runRestore(job, path string) {
+	input := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	report, err := server.RestoreArchive(context.Background(), job, input)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(body))
+}
+
+func runReconcile() {
+	before, after, err := server.ReconcileCounters(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	body, err := json.MarshalIndent(map[string]models.Status{"before": before, "after": after}, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(body))
+}
+
+func runFsck(repair bool) {
+	report, err := server.Fsck(context.Background(), repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(body))
+}
+
 func main() {
+	flag.DurationVar(&server.IdempotencyWindow, "idempotency-window", server.IdempotencyWindow,
+		"how long responses to requests with an Idempotency-Key are kept for replay")
+	flag.Float64Var(&server.ReadLimit.Rate, "read-rate", server.ReadLimit.Rate,
+		"read requests per second allowed per client and route, 0 (the default) disables the limit")
+	flag.IntVar(&server.ReadLimit.Burst, "read-burst", server.ReadLimit.Burst,
+		"read requests a client may send at once per route")
+	flag.Float64Var(&server.WriteLimit.Rate, "write-rate", server.WriteLimit.Rate,
+		"write requests per second allowed per client and route, 0 (the default) disables the limit")
+	flag.IntVar(&server.WriteLimit.Burst, "write-burst", server.WriteLimit.Burst,
+		"write requests a client may send at once per route")
+	flag.BoolVar(&server.SharedRateLimit, "rate-limit-shared", server.SharedRateLimit,
+		"count rate limits in Postgres so they hold across instances")
+	flag.IntVar(&server.MaxBodySize, "max-body-size", server.MaxBodySize,
+		"largest request body accepted by routes other than import and restore, in bytes")
+	flag.Int64Var(&server.MaxStreamBodySize, "max-stream-body-size", server.MaxStreamBodySize,
+		"largest request body accepted by import and restore, in bytes")
+	flag.IntVar(&server.MaxPostsBatch, "max-posts-batch", server.MaxPostsBatch,
+		"most posts accepted in a single create request")
+	flag.IntVar(&server.MaxListLimit, "max-list-limit", server.MaxListLimit,
+		"largest page any listing returns, also used when limit is 0")
+	flag.BoolVar(&server.PreparedStatements, "prepare", server.PreparedStatements,
+		"prepare storage queries on every connection instead of sending them as text")
+	flag.IntVar(&dbMaxConns, "db-max-conns", dbMaxConns,
+		"most connections the pool opens to Postgres")
+	flag.DurationVar(&dbMaxConnLifetime, "db-max-conn-lifetime", dbMaxConnLifetime,
+		"how long a connection is used before the pool replaces it")
+	flag.DurationVar(&dbMaxConnIdleTime, "db-max-conn-idle-time", dbMaxConnIdleTime,
+		"how long an idle connection is kept open")
+	flag.DurationVar(&dbHealthCheckPeriod, "db-health-check-period", dbHealthCheckPeriod,
+		"how often idle connections are checked and expired ones closed")
+	flag.Var(&replicaConnStrings, "replica",
+		"connection string of a read replica for listings and status, may be repeated")
+	flag.DurationVar(&server.MaxReplicaLag, "replica-max-lag", server.MaxReplicaLag,
+		"replication lag past which reads go back to the primary")
+	flag.StringVar(&server.AdminToken, "admin-token", server.AdminToken,
+		"bearer token that unlocks admin-only requests such as user lookup by email, empty for none")
+	flag.BoolVar(&server.WebhookAllowPrivate, "webhook-allow-private", server.WebhookAllowPrivate,
+		"let webhooks deliver to loopback and private addresses, for local receivers")
+	flag.DurationVar(&server.TrendingHalfLife, "trending-half-life", server.TrendingHalfLife,
+		"how long it takes a vote or a post to count half in trending scores")
+	flag.Float64Var(&server.TrendingVoteWeight, "trending-vote-weight", server.TrendingVoteWeight,
+		"weight of a thread's votes in its trending score")
+	flag.Float64Var(&server.TrendingPostWeight, "trending-post-weight", server.TrendingPostWeight,
+		"weight of a thread's recent posts in its trending score")
+	flag.DurationVar(&server.TrendingRefreshEvery, "trending-refresh", server.TrendingRefreshEvery,
+		"how often trending scores are recomputed")
+	flag.Parse()
+
+	err := connectDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	args := flag.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "import":
+			if len(args) != 3 {
+				log.Fatal("usage: main import <job> <file.ndjson|->")
+			}
+			runImport(args[1], args[2])
+			return
+		case "export":
+			if len(args) > 2 {
+				log.Fatal("usage: main export [forum]")
+			}
+			forum := ""
+			if len(args) == 2 {
+				forum = args[1]
+			}
+			runExport(forum)
+			return
+		case "restore":
+			if len(args) != 3 {
+				log.Fatal("usage: main restore <job> <archive.ndjson|->")
+			}
+			runRestore(args[1], args[2])
+			return
+		case "reconcile":
+			if len(args) != 1 {
+				log.Fatal("usage: main reconcile")
+			}
+			runReconcile()
+			return
+		case "fsck":
+			if len(args) > 2 || len(args) == 2 && args[1] != "repair" {
+				log.Fatal("usage: main fsck [repair]")
+			}
+			runFsck(len(args) == 2)
+			return
+		default:
+			log.Fatalf("unknown command %s", args[0])
+		}
+	}
+
 	runServer(":5000")
 }
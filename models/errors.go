@@ -13,6 +13,7 @@ var (
 	ErrInternalServerError = errors.New("Internal Server Error")
 )
 
+//easyjson:json
 type Error struct {
 	Message string `json:"message"`
 }
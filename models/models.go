@@ -1,42 +1,60 @@
 package models
 
+//go:generate easyjson models.go errors.go
+
 import (
 	"database/sql"
 	"encoding/json"
 	"time"
 
 	"github.com/jackc/pgtype"
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/mailru/easyjson/jlexer"
+	"github.com/mailru/easyjson/jwriter"
 )
 
-var DB *pgx.ConnPool
+var DB *pgxpool.Pool
 
+//easyjson:json
 type User struct {
-	About    string `json:"about"`
-	Email    string `json:"email"`
-	Fullname string `json:"fullname"`
-	Nickname string `json:"nickname"`
+	About    string    `json:"about"`
+	Email    string    `json:"email"`
+	Fullname string    `json:"fullname"`
+	Nickname string    `json:"nickname"`
+	Version  int64     `json:"version,omitempty"`
+	Updated  time.Time `json:"-"`
 }
 
+//easyjson:json
 type Forum struct {
-	Posts   int    `json:"posts"`
-	Slug    string `json:"slug"`
-	Threads int    `json:"threads"`
-	Title   string `json:"title"`
-	User    string `json:"user"`
+	Posts        int        `json:"posts"`
+	Slug         string     `json:"slug"`
+	Threads      int        `json:"threads"`
+	Title        string     `json:"title"`
+	User         string     `json:"user"`
+	LastActivity *time.Time `json:"lastActivity,omitempty"`
+	Version      int64      `json:"-"`
+	Updated      time.Time  `json:"-"`
 }
 
+//easyjson:json
 type Thread struct {
-	Author  string         `json:"author"`
-	Created time.Time      `json:"created"`
-	Forum   string         `json:"forum"`
-	ID      int            `json:"id"`
-	Message string         `json:"message"`
-	Slug    JsonNullString `json:"slug"`
-	Title   string         `json:"title"`
-	Votes   int            `json:"votes"`
+	Author      string         `json:"author"`
+	Created     time.Time      `json:"created"`
+	Forum       string         `json:"forum"`
+	ID          int            `json:"id"`
+	Message     string         `json:"message"`
+	Slug        JsonNullString `json:"slug"`
+	Title       string         `json:"title"`
+	Votes       int            `json:"votes"`
+	Posts       int            `json:"posts"`
+	LastPostAt  *time.Time     `json:"lastPostAt,omitempty"`
+	PostsEdited time.Time      `json:"-"`
+	Version     int64          `json:"version,omitempty"`
+	Updated     time.Time      `json:"-"`
 }
 
+//easyjson:json
 type Post struct {
 	Author   string           `json:"author"`
 	Created  time.Time        `json:"created"`
@@ -47,10 +65,55 @@ type Post struct {
 	Parent   JsonNullInt64    `json:"parent"`
 	Thread   int              `json:"thread,"`
 	Path     pgtype.Int8Array `json:"-"`
+	Version  int64            `json:"version,omitempty"`
+	Updated  time.Time        `json:"-"`
+}
+
+//easyjson:json
+type Users []User
+
+//easyjson:json
+type Threads []Thread
+
+//easyjson:json
+type Forums []Forum
+
+// TrendingThread is a thread with the score it was last ranked by.
+//
+//easyjson:json
+type TrendingThread struct {
+	Thread
+	Score float64 `json:"score"`
+}
+
+//easyjson:json
+type Posts []Post
+
+// PostFull is a post together with the related entities asked for.
+//
+//easyjson:json
+type PostFull struct {
+	Post   *Post   `json:"post"`
+	Author *User   `json:"author,omitempty"`
+	Thread *Thread `json:"thread,omitempty"`
+	Forum  *Forum  `json:"forum,omitempty"`
+}
+
+// PostContext places a post in its discussion: the posts it answers, from
+// the root down, and its nearest siblings on either side.
+//
+//easyjson:json
+type PostContext struct {
+	Ancestors []Post `json:"ancestors"`
+	Before    []Post `json:"before"`
+	Post      Post   `json:"post"`
+	After     []Post `json:"after"`
 }
 
+//easyjson:json
 type PostUpdate struct {
 	Message string `json:"message"`
+	Version int64  `json:"version"`
 }
 
 type JsonNullInt64 struct {
@@ -65,6 +128,24 @@ func (v JsonNullInt64) MarshalJSON() ([]byte, error) {
 	}
 }
 
+func (v JsonNullInt64) MarshalEasyJSON(w *jwriter.Writer) {
+	if v.Valid {
+		w.Int64(v.Int64)
+	} else {
+		w.RawString("null")
+	}
+}
+
+func (v *JsonNullInt64) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	if l.IsNull() {
+		l.Skip()
+		v.Valid = false
+	} else {
+		v.Int64 = l.Int64()
+		v.Valid = true
+	}
+}
+
 func (v *JsonNullInt64) UnmarshalJSON(data []byte) error {
 	var x *int64
 	if err := json.Unmarshal(data, &x); err != nil {
@@ -91,6 +172,24 @@ func (v JsonNullString) MarshalJSON() ([]byte, error) {
 	}
 }
 
+func (v JsonNullString) MarshalEasyJSON(w *jwriter.Writer) {
+	if v.Valid {
+		w.String(v.String)
+	} else {
+		w.RawString("null")
+	}
+}
+
+func (v *JsonNullString) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	if l.IsNull() {
+		l.Skip()
+		v.Valid = false
+	} else {
+		v.String = l.String()
+		v.Valid = true
+	}
+}
+
 func (v *JsonNullString) UnmarshalJSON(data []byte) error {
 	var x *string
 	if err := json.Unmarshal(data, &x); err != nil {
@@ -105,15 +204,134 @@ func (v *JsonNullString) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+//easyjson:json
 type Vote struct {
 	Nickname string `json:"nickname"`
 	Voice    int    `json:"voice"`
 	Thread   int    `json:"-"`
 }
 
+//easyjson:json
 type Status struct {
 	Forum  int `json:"forum"`
 	Post   int `json:"post"`
 	Thread int `json:"thread"`
 	User   int `json:"user"`
 }
+
+const (
+	EventUserCreated   = "user.created"
+	EventUserUpdated   = "user.updated"
+	EventForumCreated  = "forum.created"
+	EventThreadCreated = "thread.created"
+	EventThreadUpdated = "thread.updated"
+	EventPostCreated   = "post.created"
+	EventPostUpdated   = "post.updated"
+	EventVoteCreated   = "vote.created"
+	EventVoteUpdated   = "vote.updated"
+	EventImportMerged  = "import.merged"
+)
+
+type Event struct {
+	Seq     int64           `json:"seq"`
+	Type    string          `json:"type"`
+	Entity  string          `json:"entity"`
+	Payload json.RawMessage `json:"payload"`
+	Created time.Time       `json:"created"`
+}
+
+type Webhook struct {
+	ID      int       `json:"id"`
+	Forum   string    `json:"forum"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"`
+	Events  []string  `json:"events"`
+	Created time.Time `json:"created"`
+}
+
+type WebhookDelivery struct {
+	ID           int64           `json:"id"`
+	Webhook      int             `json:"webhook"`
+	Event        string          `json:"event"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	NextAttempt  time.Time       `json:"nextAttempt"`
+	LastError    JsonNullString  `json:"lastError"`
+	ResponseCode JsonNullInt64   `json:"responseCode"`
+	Created      time.Time       `json:"created"`
+	Delivered    *time.Time      `json:"delivered"`
+}
+
+type ImportError struct {
+	Line    int64  `json:"line"`
+	Message string `json:"message"`
+}
+
+type ImportReport struct {
+	Job        string        `json:"job"`
+	Status     string        `json:"status"`
+	Lines      int64         `json:"lines"`
+	Users      int           `json:"users"`
+	Forums     int           `json:"forums"`
+	Threads    int           `json:"threads"`
+	Posts      int           `json:"posts"`
+	ErrorCount int           `json:"errorCount"`
+	Errors     []ImportError `json:"errors"`
+}
+
+const (
+	ArchiveFormat  = "forum-archive"
+	ArchiveVersion = 1
+)
+
+type ArchiveHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Forum   string    `json:"forum"`
+	Created time.Time `json:"created"`
+}
+
+type ArchiveTrailer struct {
+	Records int64  `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// PoolStats is a snapshot of the database connection pool.
+type PoolStats struct {
+	MaxConns             int32   `json:"maxConns"`
+	TotalConns           int32   `json:"totalConns"`
+	AcquiredConns        int32   `json:"acquiredConns"`
+	IdleConns            int32   `json:"idleConns"`
+	ConstructingConns    int32   `json:"constructingConns"`
+	AcquireCount         int64   `json:"acquireCount"`
+	EmptyAcquireCount    int64   `json:"emptyAcquireCount"`
+	CanceledAcquireCount int64   `json:"canceledAcquireCount"`
+	AcquireDurationMs    float64 `json:"acquireDurationMs"`
+}
+
+// FsckIssue is a denormalized value that disagrees with the rows it is
+// derived from. Expected and Actual are null for users_forum rows.
+type FsckIssue struct {
+	Check    string        `json:"check"`
+	Forum    string        `json:"forum,omitempty"`
+	Thread   int           `json:"thread,omitempty"`
+	Nickname string        `json:"nickname,omitempty"`
+	Expected JsonNullInt64 `json:"expected"`
+	Actual   JsonNullInt64 `json:"actual"`
+}
+
+type FsckReport struct {
+	Forums   int         `json:"forums"`
+	Threads  int         `json:"threads"`
+	Issues   int         `json:"issues"`
+	Repaired bool        `json:"repaired"`
+	Details  []FsckIssue `json:"details"`
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mailru/easyjson"
+)
+
+// plainPost has Post's fields without its generated methods, so
+// encoding/json marshals it by reflection, as the handlers did before
+// easyjson.
+type plainPost Post
+
+func benchmarkPosts(n int) Posts {
+	posts := make(Posts, n)
+	created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := range posts {
+		posts[i] = Post{
+			Author:  "author" + strconv.Itoa(i%10),
+			Created: created,
+			Forum:   "forum",
+			ID:      i + 1,
+			Message: "A message long enough to look like a real post in a thread, number " + strconv.Itoa(i),
+			Parent:  JsonNullInt64{sql.NullInt64{Int64: int64(i / 2), Valid: i > 0}},
+			Thread:  1,
+			Version: 1,
+		}
+	}
+	return posts
+}
+
+func plainPosts(posts Posts) []plainPost {
+	plain := make([]plainPost, len(posts))
+	for i, p := range posts {
+		plain[i] = plainPost(p)
+	}
+	return plain
+}
+
+// BenchmarkThreadPosts marshals a page of a thread's posts.
+func BenchmarkThreadPosts(b *testing.B) {
+	posts := benchmarkPosts(100)
+	plain := plainPosts(posts)
+
+	b.Run("encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(plain); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("easyjson", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := easyjson.Marshal(posts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkCreatePosts decodes a batch of new posts and encodes the created
+// posts back.
+func BenchmarkCreatePosts(b *testing.B) {
+	posts := benchmarkPosts(100)
+	body, err := easyjson.Marshal(posts)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var batch []plainPost
+			if err := json.Unmarshal(body, &batch); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := json.Marshal(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("easyjson", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var batch Posts
+			if err := easyjson.Unmarshal(body, &batch); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := easyjson.Marshal(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestPlainPostMatchesEasyJSON(t *testing.T) {
+	posts := benchmarkPosts(3)
+	generated, err := easyjson.Marshal(posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reflected, err := json.Marshal(plainPosts(posts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(generated) != string(reflected) {
+		t.Fatalf("easyjson and encoding/json disagree:\n%s\n%s", generated, reflected)
+	}
+}
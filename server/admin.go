@@ -0,0 +1,18 @@
+package server
+
+import (
+	"crypto/subtle"
+	"github.com/valyala/fasthttp"
+)
+
+// AdminToken unlocks the admin-only parts of the API for requests sending it
+// as "Authorization: Bearer <token>". When empty there are no admins.
+var AdminToken = ""
+
+func isAdmin(ctx *fasthttp.RequestCtx) bool {
+	if AdminToken == "" {
+		return false
+	}
+	token := ctx.Request.Header.Peek("Authorization")
+	return subtle.ConstantTimeCompare(token, []byte("Bearer "+AdminToken)) == 1
+}
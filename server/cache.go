@@ -0,0 +1,231 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"forum_dbms/models"
+	"github.com/jackc/pgx/v4"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var notifyCacheStmt = statement("notifyCache", `SELECT pg_notify($1, $2);`)
+
+const (
+	cacheSize              = 10000
+	cacheTTL               = 30 * time.Second
+	cacheChannel           = "forum_cache"
+	cacheListenerRetryWait = time.Second
+)
+
+var (
+	userCache     = newLRUCache(cacheSize, cacheTTL)
+	forumCache    = newLRUCache(cacheSize, cacheTTL)
+	threadCache   = newLRUCache(cacheSize, cacheTTL)
+	threadIDCache = newLRUCache(cacheSize, cacheTTL)
+)
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// lruCache is a size-bounded map whose entries also expire after ttl.
+type lruCache struct {
+	mu        sync.Mutex
+	size      int
+	ttl       time.Duration
+	items     map[string]*list.Element
+	order     *list.List
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		c.misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	c.hits++
+	return entry.value, true
+}
+
+func (c *lruCache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.items[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+		c.evictions++
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+}
+
+func (c *lruCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]*list.Element, c.size)
+	c.order.Init()
+}
+
+func (c *lruCache) stats() models.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return models.CacheStats{Size: c.order.Len(), Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// Citext columns compare case-insensitively, so cache keys do too.
+func cacheKey(s string) string {
+	return strings.ToLower(s)
+}
+
+func userCacheKey(nickname string) string {
+	return "user:" + cacheKey(nickname)
+}
+
+func forumCacheKey(slug string) string {
+	return "forum:" + cacheKey(slug)
+}
+
+func threadCacheKey(id int) string {
+	return "thread:" + strconv.Itoa(id)
+}
+
+// invalidateCache drops the given keys locally and, once tx commits, on every
+// other instance listening on cacheChannel.
+func invalidateCache(ctx context.Context, tx pgx.Tx, keys ...string) error {
+	for _, key := range keys {
+		_, err := tx.Exec(ctx, stmt(notifyCacheStmt), cacheChannel, key)
+		if err != nil {
+			return err
+		}
+		applyCacheInvalidation(key)
+	}
+	return nil
+}
+
+func applyCacheInvalidation(key string) {
+	switch {
+	case key == "*":
+		purgeCaches()
+	case strings.HasPrefix(key, "user:"):
+		userCache.remove(key)
+	case strings.HasPrefix(key, "forum:"):
+		forumCache.remove(key)
+	case strings.HasPrefix(key, "thread:"):
+		threadCache.remove(key)
+	}
+}
+
+func purgeCaches() {
+	userCache.purge()
+	forumCache.purge()
+	threadCache.purge()
+	threadIDCache.purge()
+}
+
+// RunCacheListener applies invalidations sent by other instances. Caches are
+// purged whenever the connection is lost, since notifications may be missed.
+func RunCacheListener() {
+	for {
+		err := listenCacheInvalidations()
+		log.Println(err)
+		purgeCaches()
+		time.Sleep(cacheListenerRetryWait)
+	}
+}
+
+func listenCacheInvalidations() error {
+	ctx := context.Background()
+	conn, err := models.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `LISTEN `+cacheChannel+`;`)
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		applyCacheInvalidation(notification.Payload)
+	}
+}
+
+func CacheStatsHandler(ctx *fasthttp.RequestCtx) {
+	stats := map[string]models.CacheStats{
+		"user":   userCache.stats(),
+		"forum":  forumCache.stats(),
+		"thread": threadCache.stats(),
+		"slug":   threadIDCache.stats(),
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
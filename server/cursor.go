@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// listCursor is where a page of a directory listing ended: the value of the
+// sort column and the unique key that breaks ties. It goes out base64 encoded
+// in X-Next-Cursor and comes back as the cursor parameter.
+type listCursor struct {
+	Sort  string          `json:"sort"`
+	Value json.RawMessage `json:"value"`
+	Key   string          `json:"key"`
+}
+
+var errBadCursor = errors.New("cursor does not belong to this sort")
+
+func encodeCursor(sort string, value interface{}, key string) (string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	cursor, err := json.Marshal(listCursor{Sort: sort, Value: raw, Key: key})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(cursor), nil
+}
+
+// decodeCursor fills value with the sort value a page continues after and
+// returns its key. An empty cursor leaves value alone and returns no key.
+func decodeCursor(encoded, sort string, value interface{}) (string, error) {
+	if encoded == "" {
+		return "", nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	var cursor listCursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return "", err
+	}
+	if cursor.Sort != sort || cursor.Key == "" {
+		return "", errBadCursor
+	}
+	return cursor.Key, json.Unmarshal(cursor.Value, value)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"forum_dbms/models"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entityTag builds a strong ETag from whatever identifies a representation,
+// usually the entity kind, its key and its row version.
+func entityTag(parts ...interface{}) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprint(h, part, "\x00")
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// versionTag is an entityTag that ends in the row version, so an edit can
+// check If-Match against the version column instead of reading the row first.
+// state holds what else the representation shows, such as counters, which
+// change the tag but not the version.
+func versionTag(kind string, key interface{}, version int64, state ...interface{}) string {
+	tag := entityTag(append([]interface{}{kind, key, version}, state...)...)
+	return strings.TrimSuffix(tag, `"`) + "-" + strconv.FormatInt(version, 10) + `"`
+}
+
+func userTag(u models.User) string {
+	return versionTag("user", cacheKey(u.Nickname), u.Version)
+}
+
+func forumTag(f models.Forum) string {
+	return versionTag("forum", cacheKey(f.Slug), f.Version, f.Posts, f.Threads, unixNano(f.LastActivity))
+}
+
+func threadTag(th models.Thread) string {
+	return versionTag("thread", th.ID, th.Version, th.Votes, th.Posts, unixNano(th.LastPostAt))
+}
+
+// threadPostsTag identifies a page of a thread's posts. It is built from the
+// thread row alone: a new post moves its post count and last post, an edit
+// its posts_edited time.
+func threadPostsTag(th models.Thread, page ...interface{}) string {
+	parts := []interface{}{"posts", th.ID, th.Posts, unixNano(th.LastPostAt), th.PostsEdited.UnixNano(), th.Version}
+	return entityTag(append(parts, page...)...)
+}
+
+func threadPostsModified(th models.Thread) time.Time {
+	if th.LastPostAt == nil {
+		return th.PostsEdited
+	}
+	return latest(*th.LastPostAt, th.PostsEdited)
+}
+
+func postTag(p models.Post) string {
+	return versionTag("post", p.ID, p.Version)
+}
+
+func unixNano(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// notModified sets the ETag and Last-Modified headers and, when the request's
+// validators still match, answers 304 and returns true. If-None-Match wins
+// over If-Modified-Since, as RFC 7232 requires.
+func notModified(ctx *fasthttp.RequestCtx, etag string, modified time.Time) bool {
+	ctx.Response.Header.Set("ETag", etag)
+	if !modified.IsZero() {
+		ctx.Response.Header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	match := false
+	if inm := string(ctx.Request.Header.Peek("If-None-Match")); inm != "" {
+		match = etagListMatches(inm, etag)
+	} else if ims := string(ctx.Request.Header.Peek("If-Modified-Since")); ims != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		match = err == nil && !modified.Truncate(time.Second).After(since)
+	}
+	if !match {
+		return false
+	}
+
+	ctx.SetStatusCode(http.StatusNotModified)
+	ctx.ResetBody()
+	return true
+}
+
+// etagListMatches uses the weak comparison If-None-Match calls for.
+func etagListMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion reads the version an edit expects from its If-Match header:
+// 0 for "*", which any version satisfies, and -1, which none does, when no
+// candidate is the whole strong tag tag gives for the version it ends in. tag
+// builds the ETag of the entity being edited at a version, so a tag issued for
+// another entity, or forged, never authorises a write, and neither do weak tags.
+func ifMatchVersion(ctx *fasthttp.RequestCtx, tag func(version int64) string) int64 {
+	for _, candidate := range strings.Split(string(ctx.Request.Header.Peek("If-Match")), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return 0
+		}
+		if len(candidate) < 2 || candidate[0] != '"' || candidate[len(candidate)-1] != '"' {
+			continue
+		}
+		dash := strings.LastIndexByte(candidate, '-')
+		if dash < 0 {
+			continue
+		}
+		version, err := strconv.ParseInt(candidate[dash+1:len(candidate)-1], 10, 64)
+		if err == nil && version > 0 && candidate == tag(version) {
+			return version
+		}
+	}
+	return -1
+}
+
+// expectedVersion combines If-Match with the version field of an edit. The
+// update only applies while the row still has that version; 0 applies it
+// unconditionally and -1 fails it, as when the two disagree.
+func expectedVersion(ctx *fasthttp.RequestCtx, version int64, tag func(version int64) string) int64 {
+	if len(ctx.Request.Header.Peek("If-Match")) == 0 {
+		return version
+	}
+	matched := ifMatchVersion(ctx, tag)
+	switch {
+	case matched == 0:
+		return version
+	case version != 0 && version != matched:
+		return -1
+	}
+	return matched
+}
+
+// preconditionFailed answers 412 with the current representation, so the
+// client can merge its edit and retry with the new ETag or version.
+func preconditionFailed(ctx *fasthttp.RequestCtx, current interface{}, etag string) {
+	body, err := json.Marshal(current)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.Response.Header.Set("ETag", etag)
+	ctx.SetStatusCode(http.StatusPreconditionFailed)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
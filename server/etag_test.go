@@ -0,0 +1,95 @@
+package server
+
+import (
+	"forum_dbms/models"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestExpectedVersion(t *testing.T) {
+	tag := postTag(models.Post{ID: 7, Version: 3})
+	post7 := func(version int64) string {
+		return postTag(models.Post{ID: 7, Version: version})
+	}
+	tests := []struct {
+		ifMatch string
+		body    int64
+		want    int64
+	}{
+		{"", 0, 0},
+		{"", 5, 5},
+		{tag, 0, 3},
+		{tag, 3, 3},
+		{tag, 4, -1},
+		{"W/" + tag, 0, -1},
+		{`"garbage"`, 0, -1},
+		{`"garbage-3"`, 0, -1},
+		{postTag(models.Post{ID: 8, Version: 3}), 0, -1},
+		{`"other", ` + tag, 0, 3},
+		{"*", 0, 0},
+		{"*", 2, 2},
+	}
+	for _, tt := range tests {
+		ctx := testRequest(fasthttp.MethodPost, "/", "", nil)
+		if tt.ifMatch != "" {
+			ctx.Request.Header.Set("If-Match", tt.ifMatch)
+		}
+		if got := expectedVersion(ctx, tt.body, post7); got != tt.want {
+			t.Errorf("expectedVersion(If-Match %s, %d) = %d, want %d", tt.ifMatch, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestCountersChangeTagsButNotVersions(t *testing.T) {
+	thread := models.Thread{ID: 1, Version: 2}
+	voted := thread
+	voted.Votes = 1
+	if threadTag(thread) == threadTag(voted) {
+		t.Fatal("a vote did not change the thread's ETag")
+	}
+	if voted.Version != thread.Version {
+		t.Fatal("a vote changed the thread's version")
+	}
+}
+
+func editThread(thread int, ifMatch, body string) *fasthttp.RequestCtx {
+	id := strconv.Itoa(thread)
+	ctx := testRequest(fasthttp.MethodPost, "/api/thread/"+id+"/details", body, map[string]string{"threadnameOrID": id})
+	ctx.Request.Header.Set("If-Match", ifMatch)
+	EditThread(ctx)
+	return ctx
+}
+
+func TestEditThreadChecksTheWholeTag(t *testing.T) {
+	ctx := testDB(t)
+	testUser(t, ctx, "author")
+	testUser(t, ctx, "voter")
+	testForum(t, ctx, "edits", "author")
+	thread := testThread(t, ctx, "edits", "author", time.Now())
+	etag := threadTag(thread)
+
+	err := InsertVote(ctx, models.Vote{Nickname: "voter", Voice: 1, Thread: thread.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := editThread(thread.ID, etag, `{"title":"after the vote"}`)
+	if status := stale.Response.StatusCode(); status != http.StatusPreconditionFailed {
+		t.Fatalf("edit with a tag from before the vote = %d, want %d", status, http.StatusPreconditionFailed)
+	}
+
+	current := string(stale.Response.Header.Peek("ETag"))
+	edited := editThread(thread.ID, current, `{"title":"after the vote"}`)
+	if status := edited.Response.StatusCode(); status != http.StatusOK {
+		t.Fatalf("edit with the current tag = %d, want %d: %s", status, http.StatusOK, edited.Response.Body())
+	}
+
+	forged := editThread(thread.ID, `"forged-`+strconv.FormatInt(thread.Version+1, 10)+`"`, `{"title":"forged"}`)
+	if status := forged.Response.StatusCode(); status != http.StatusPreconditionFailed {
+		t.Fatalf("edit with a forged tag = %d, want %d", status, http.StatusPreconditionFailed)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func EventsHandler(ctx *fasthttp.RequestCtx) {
+	queryParams := ctx.QueryArgs()
+
+	afterParam := string(queryParams.Peek("after"))
+	var after int64
+	var err error
+	if afterParam != "" {
+		after, err = strconv.ParseInt(afterParam, 10, 64)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+	}
+
+	limitParam := string(queryParams.Peek("limit"))
+	limit := 100
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := SelectEvents(ctx, after, limit)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(events) == 0 {
+		ctx.SetStatusCode(http.StatusOK)
+		ctx.SetContentType("application/json")
+		ctx.SetBody([]byte("[]"))
+		return
+	}
+
+	body, err := json.Marshal(events)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"forum_dbms/models"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	insertEventStmt = statement("insertEvent", `INSERT INTO events(type, entity, payload) VALUES ($1, $2, $3::jsonb);`)
+
+	insertEventsStmt = statement("insertEvents", `INSERT INTO events(type, entity, payload)
+		SELECT $1, p.value->>$2, p.value FROM jsonb_array_elements($3::jsonb) WITH ORDINALITY p ORDER BY p.ordinality;`)
+
+	selectEventsStmt = statement("selectEvents", `SELECT seq, type, entity, payload::text, created FROM events
+		WHERE xid < txid_snapshot_xmin(txid_current_snapshot())
+		AND ($1 = 0 OR (xid, seq) > (SELECT a.xid, a.seq FROM events a WHERE a.seq = $1))
+		ORDER BY xid, seq LIMIT NULLIF($2, 0);`)
+)
+
+// AppendEvent records a change in the events log within tx.
+func AppendEvent(ctx context.Context, tx pgx.Tx, kind, entity string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, stmt(insertEventStmt), kind, entity, string(data))
+	return err
+}
+
+// AppendEvents is AppendEvent for a batch: one event per element of payload,
+// with the entity taken from the element's key field.
+func AppendEvents(ctx context.Context, tx pgx.Tx, kind, key string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, stmt(insertEventsStmt), kind, key, string(data))
+	return err
+}
+
+// SelectEvents returns the events after the one numbered after. Writers take
+// no lock, so seq is handed out in insert order, not commit order, and a
+// reader tailing by seq could skip a slow transaction's event. The log is read
+// in order of the writing transaction's id instead, and only up to the oldest
+// transaction still running: every event before that point has committed or
+// never will. A long transaction holds the feed back until it ends.
+func SelectEvents(ctx context.Context, after int64, limit int) ([]models.Event, error) {
+	var events []models.Event
+	rows, err := models.DB.Query(ctx, stmt(selectEventsStmt), after, limit)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.Event
+		var payload string
+		err = rows.Scan(&e.Seq, &e.Type, &e.Entity, &payload, &e.Created)
+		if err != nil {
+			return events, err
+		}
+		e.Payload = json.RawMessage(payload)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"forum_dbms/models"
+	"testing"
+)
+
+func TestEventsWaitForEarlierTransactions(t *testing.T) {
+	ctx := testDB(t)
+
+	slow, err := models.DB.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Rollback(ctx)
+	err = AppendEvent(ctx, slow, models.EventUserCreated, "slow", map[string]string{"nickname": "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fast, err := models.DB.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AppendEvent(ctx, fast, models.EventUserCreated, "fast", map[string]string{"nickname": "fast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fast.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fast event committed, but handing it out now would let a reader
+	// move past the slow one before it commits.
+	events, err := SelectEvents(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("got %d events while an earlier transaction runs, want 0", len(events))
+	}
+
+	err = slow.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err = SelectEvents(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Entity != "slow" || events[1].Entity != "fast" {
+		t.Fatalf("events = %+v, want slow then fast", events)
+	}
+
+	events, err = SelectEvents(ctx, events[0].Seq, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Entity != "fast" {
+		t.Fatalf("events after slow = %+v, want fast", events)
+	}
+}
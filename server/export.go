@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"forum_dbms/models"
+	"github.com/valyala/fasthttp"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type archiveVote struct {
+	Nickname string `json:"nickname"`
+	Voice    int    `json:"voice"`
+	Thread   int    `json:"thread"`
+}
+
+type archiveRecord struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// archiveWriter writes NDJSON records and keeps the running checksum that the
+// trailer line carries.
+type archiveWriter struct {
+	w       io.Writer
+	sum     hash.Hash
+	records int64
+}
+
+func (a *archiveWriter) write(kind string, data interface{}) error {
+	line, err := json.Marshal(archiveRecord{Type: kind, Data: data})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.sum.Write(line)
+	_, err = a.w.Write(line)
+	return err
+}
+
+func (a *archiveWriter) record(kind string, data interface{}) error {
+	a.records++
+	return a.write(kind, data)
+}
+
+// ExportNDJSON streams a versioned archive of forum, or of the whole database
+// when forum is empty, to w.
+func ExportNDJSON(ctx context.Context, forum string, w io.Writer) error {
+	source, err := beginArchiveSource(ctx, forum)
+	if err != nil {
+		return err
+	}
+	defer source.close()
+
+	archive := &archiveWriter{w: w, sum: sha256.New()}
+	err = archive.write("header", models.ArchiveHeader{
+		Format:  models.ArchiveFormat,
+		Version: models.ArchiveVersion,
+		Forum:   forum,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = source.users(func(u models.User) error { return archive.record("user", u) })
+	if err != nil {
+		return err
+	}
+	err = source.forums(func(f models.Forum) error { return archive.record("forum", f) })
+	if err != nil {
+		return err
+	}
+	err = source.threads(func(th models.Thread) error { return archive.record("thread", th) })
+	if err != nil {
+		return err
+	}
+	err = source.posts(func(p models.Post) error { return archive.record("post", p) })
+	if err != nil {
+		return err
+	}
+	err = source.votes(func(v archiveVote) error { return archive.record("vote", v) })
+	if err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(archive.sum.Sum(nil))
+	return archive.write("trailer", models.ArchiveTrailer{Records: archive.records, SHA256: checksum})
+}
+
+// archiveVerifier checks the header, record count and checksum of an archive
+// while it is being imported.
+type archiveVerifier struct {
+	sum      hash.Hash
+	records  int64
+	header   bool
+	complete bool
+}
+
+func newArchiveVerifier() *archiveVerifier {
+	return &archiveVerifier{sum: sha256.New()}
+}
+
+func (a *archiveVerifier) check(raw []byte) error {
+	if a.complete {
+		return errors.New("archive has data after the trailer")
+	}
+
+	var record importRecord
+	err := json.Unmarshal(raw, &record)
+	if err != nil || (!a.header && record.Type != "header") {
+		return errors.New("archive must start with a header")
+	}
+
+	switch record.Type {
+	case "header":
+		if a.header {
+			return errors.New("archive has more than one header")
+		}
+		var header models.ArchiveHeader
+		if err := json.Unmarshal(record.Data, &header); err != nil {
+			return err
+		}
+		if header.Format != models.ArchiveFormat || header.Version != models.ArchiveVersion {
+			return errors.New("unsupported archive format or version")
+		}
+		a.header = true
+	case "trailer":
+		var trailer models.ArchiveTrailer
+		if err := json.Unmarshal(record.Data, &trailer); err != nil {
+			return err
+		}
+		if trailer.Records != a.records || trailer.SHA256 != hex.EncodeToString(a.sum.Sum(nil)) {
+			return errors.New("archive checksum mismatch")
+		}
+		a.complete = true
+		return nil
+	default:
+		a.records++
+	}
+
+	a.sum.Write(raw)
+	a.sum.Write([]byte{'\n'})
+	return nil
+}
+
+// RestoreArchive imports an archive produced by ExportNDJSON. Nothing is merged
+// unless the whole archive passes verification.
+func RestoreArchive(ctx context.Context, job string, r io.Reader) (models.ImportReport, error) {
+	return importStream(ctx, job, r, newArchiveVerifier())
+}
+
+func ExportForumHandler(ctx *fasthttp.RequestCtx) {
+	forumnameInterface := ctx.UserValue("forumname")
+
+	var slug string
+	switch forumnameInterface.(type) {
+	case string:
+		slug = forumnameInterface.(string)
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	forum, err := SelectForum(ctx, slug)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't find forum"))
+		return
+	}
+
+	streamArchive(ctx, forum.Slug)
+}
+
+func ExportHandler(ctx *fasthttp.RequestCtx) {
+	if !isAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Only admins can export the whole database"))
+		return
+	}
+
+	streamArchive(ctx, "")
+}
+
+func streamArchive(ctx *fasthttp.RequestCtx, forum string) {
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/x-ndjson")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		err := ExportNDJSON(ctx, forum, w)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+func RestoreHandler(ctx *fasthttp.RequestCtx) {
+	if !isAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Only admins can restore"))
+		return
+	}
+
+	job := string(ctx.QueryArgs().Peek("job"))
+	if job == "" {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Import job id is required"))
+		return
+	}
+
+	report, err := RestoreArchive(ctx, job, requestBodyReader(ctx))
+	if err != nil {
+		importFailed(ctx, err)
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	exportUsersStmt = statement("exportUsers", `SELECT about, COALESCE(email, ''), fullname, nickname FROM users WHERE $1::citext = ''
+		OR nickname IN (SELECT nickname FROM users_forum WHERE slug = $1
+			UNION SELECT username FROM forums WHERE slug = $1
+			UNION SELECT v.nickname FROM votes v JOIN threads t ON t.id = v.thread WHERE t.forum = $1)
+		ORDER BY nickname;`)
+
+	exportForumsStmt = statement("exportForums", `SELECT username, posts, threads, slug, title FROM forums
+		WHERE $1::citext = '' OR slug = $1 ORDER BY slug;`)
+
+	exportThreadsStmt = statement("exportThreads", `SELECT author, created, forum, id, message, slug, title, votes FROM threads
+		WHERE $1::citext = '' OR forum = $1 ORDER BY id;`)
+
+	exportPostsStmt = statement("exportPosts", `SELECT author, created, forum, id, is_edited, message, parent, thread FROM posts
+		WHERE $1::citext = '' OR forum = $1 ORDER BY id;`)
+
+	exportVotesStmt = statement("exportVotes", `SELECT v.nickname, v.voice, v.thread FROM votes v JOIN threads t ON t.id = v.thread
+		WHERE $1::citext = '' OR t.forum = $1 ORDER BY v.thread, v.nickname;`)
+)
+
+// archiveSource reads one consistent snapshot of a forum, or of everything when
+// the forum is empty, and hands every row to the callbacks in restore order.
+type archiveSource struct {
+	ctx   context.Context
+	tx    pgx.Tx
+	forum string
+}
+
+func beginArchiveSource(ctx context.Context, forum string) (*archiveSource, error) {
+	tx, err := models.DB.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &archiveSource{ctx: ctx, tx: tx, forum: forum}, nil
+}
+
+func (s *archiveSource) close() {
+	s.tx.Rollback(s.ctx)
+}
+
+func (s *archiveSource) users(fn func(models.User) error) error {
+	rows, err := s.tx.Query(s.ctx, stmt(exportUsersStmt), s.forum)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		err = rows.Scan(&u.About, &u.Email, &u.Fullname, &u.Nickname)
+		if err != nil {
+			return err
+		}
+		if err = fn(u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *archiveSource) forums(fn func(models.Forum) error) error {
+	rows, err := s.tx.Query(s.ctx, stmt(exportForumsStmt), s.forum)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f models.Forum
+		err = rows.Scan(&f.User, &f.Posts, &f.Threads, &f.Slug, &f.Title)
+		if err != nil {
+			return err
+		}
+		if err = fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *archiveSource) threads(fn func(models.Thread) error) error {
+	rows, err := s.tx.Query(s.ctx, stmt(exportThreadsStmt), s.forum)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var th models.Thread
+		err = rows.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes)
+		if err != nil {
+			return err
+		}
+		if err = fn(th); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *archiveSource) posts(fn func(models.Post) error) error {
+	rows, err := s.tx.Query(s.ctx, stmt(exportPostsStmt), s.forum)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.Post
+		err = rows.Scan(&p.Author, &p.Created, &p.Forum, &p.ID, &p.IsEdited, &p.Message, &p.Parent, &p.Thread)
+		if err != nil {
+			return err
+		}
+		if err = fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *archiveSource) votes(fn func(archiveVote) error) error {
+	rows, err := s.tx.Query(s.ctx, stmt(exportVotesStmt), s.forum)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v archiveVote
+		err = rows.Scan(&v.Nickname, &v.Voice, &v.Thread)
+		if err != nil {
+			return err
+		}
+		if err = fn(v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"forum_dbms/models"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// testArchive builds an archive of users numbered past importBatchLines, so
+// that restoring it checkpoints a batch before the trailer is read.
+func testArchive(t *testing.T, users int) []byte {
+	var buf bytes.Buffer
+	archive := &archiveWriter{w: &buf, sum: sha256.New()}
+	err := archive.write("header", models.ArchiveHeader{
+		Format:  models.ArchiveFormat,
+		Version: models.ArchiveVersion,
+		Created: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < users; i++ {
+		nickname := "user" + strconv.Itoa(i)
+		err = archive.record("user", models.User{Nickname: nickname, Fullname: "User " + nickname})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = archive.write("trailer", models.ArchiveTrailer{Records: archive.records, SHA256: hex.EncodeToString(archive.sum.Sum(nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRestoreDiscardsArchiveThatFailsVerification(t *testing.T) {
+	ctx := testDB(t)
+	users := importBatchLines + 100
+	archive := testArchive(t, users)
+
+	// The last user changes after the checksum was taken, so the archive
+	// only fails at its trailer, after the first batch is staged.
+	last := []byte(`"nickname":"user` + strconv.Itoa(users-1) + `"`)
+	tampered := bytes.Replace(archive, last, []byte(`"nickname":"intruder"`), 1)
+	if bytes.Equal(tampered, archive) {
+		t.Fatal("archive has no user to tamper with")
+	}
+
+	_, err := RestoreArchive(ctx, "restore", bytes.NewReader(tampered))
+	if !errors.As(err, &inputError{}) {
+		t.Fatalf("err = %v, want an archive verification error", err)
+	}
+
+	report, err := SelectImportJob(ctx, "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != "staging" || report.Lines != 0 {
+		t.Fatalf("job after a failed archive = %s at line %d, want staging at line 0", report.Status, report.Lines)
+	}
+	var staged int
+	err = models.DB.QueryRow(ctx, `SELECT COUNT(*) FROM import_users WHERE job = 'restore';`).Scan(&staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staged != 0 {
+		t.Fatalf("%d users of the failed archive still staged", staged)
+	}
+
+	report, err = RestoreArchive(ctx, "restore", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != "merged" || report.Users != users {
+		t.Fatalf("retry = %s with %d users, want merged with %d", report.Status, report.Users, users)
+	}
+	if _, err := SelectUserByNickname(ctx, "intruder"); err == nil {
+		t.Fatal("user from the failed archive was merged")
+	}
+}
+
+func TestBulkRoutesRequireAdmin(t *testing.T) {
+	AdminToken = "test-token"
+	defer func() { AdminToken = "" }()
+
+	for name, handler := range map[string]fasthttp.RequestHandler{
+		"import":  ImportHandler,
+		"restore": RestoreHandler,
+		"export":  ExportHandler,
+	} {
+		ctx := testRequest(fasthttp.MethodPost, "/api/service/"+name+"?job=j", "", nil)
+		handler(ctx)
+		if status := ctx.Response.StatusCode(); status != http.StatusForbidden {
+			t.Errorf("%s without the admin token = %d, want %d", name, status, http.StatusForbidden)
+		}
+	}
+}
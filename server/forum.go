@@ -1,33 +1,34 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"forum_dbms/models"
+	"github.com/mailru/easyjson"
 	"github.com/valyala/fasthttp"
 	"log"
 	"net/http"
 	"strconv"
 	_ "strings"
+	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 )
 
 func StatusHandler(ctx *fasthttp.RequestCtx) {
-	status := StatusForum()
-	body, err := json.Marshal(status)
+	status, err := StatusForum(ctx)
 	if err != nil {
 		log.Println(err)
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't read service status"))
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, status)
 }
 
 func ClearHandler(ctx *fasthttp.RequestCtx) {
-	err := ClearDB()
+	err := ClearDB(ctx)
 	if err != nil {
 		log.Println(err)
 		return
@@ -40,31 +41,23 @@ func ClearHandler(ctx *fasthttp.RequestCtx) {
 
 func CreateForum(ctx *fasthttp.RequestCtx) {
 	var forum models.Forum
-	err := json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&forum)
+	err := easyjson.Unmarshal(ctx.Request.Body(), &forum)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	forumInserted, err := InsertForum(forum)
-	if pgErr, ok := err.(pgx.PgError); ok {
+	forumInserted, err := InsertForum(ctx, forum)
+	if pgErr, ok := err.(*pgconn.PgError); ok {
 		switch pgErr.Code {
 		case "23505":
-			forum, err = SelectForum(forum.Slug)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			body, err := json.Marshal(forum)
+			forum, err = SelectForum(ctx, forum.Slug)
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			ctx.SetStatusCode(http.StatusConflict)
-			ctx.SetContentType("application/json")
-			ctx.SetBody(body)
+			writeJSON(ctx, http.StatusConflict, forum)
 			return
 		}
 	}
@@ -76,15 +69,7 @@ func CreateForum(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(forumInserted)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	ctx.SetStatusCode(http.StatusCreated)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusCreated, forumInserted)
 }
 
 func ForumDetails(ctx *fasthttp.RequestCtx) {
@@ -99,7 +84,7 @@ func ForumDetails(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	forum, err := SelectForum(slug)
+	forum, err := SelectForum(ctx, slug)
 	if err != nil {
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
@@ -107,15 +92,11 @@ func ForumDetails(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(forum)
-	if err != nil {
-		log.Println(err)
+	if notModified(ctx, forumTag(forum), forum.Updated) {
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, forum)
 
 }
 
@@ -157,34 +138,111 @@ func ForumUsers(ctx *fasthttp.RequestCtx) {
 	sinceParam := string(queryParams.Peek("since"))
 	since := sinceParam
 
-	users, err := SelectUsersByForum(slug, since, limit, desc)
-	if err != nil {
+	if _, err := SelectForum(ctx, slug); err != nil {
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
 		ctx.SetBody(jsonToMessage("Can't find forum"))
 		return
 	}
 
-	if len(users) == 0 {
-		if _, err := SelectForum(slug); err != nil {
-			ctx.SetStatusCode(http.StatusNotFound)
-			ctx.SetContentType("application/json")
-			ctx.SetBody(jsonToMessage("Can't find forum"))
+	limit = listLimit(limit)
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectUsersByForum(ctx, slug, since, limit, desc, func(u models.User) error {
+			return emit(u)
+		})
+	})
+}
+
+// forumSortValue is the value of the sort column of forum, as its cursor
+// carries it.
+func forumSortValue(sort string, forum models.Forum) interface{} {
+	switch sort {
+	case "threads":
+		return forum.Threads
+	case "posts":
+		return forum.Posts
+	case "activity":
+		return forum.LastActivity
+	default:
+		return forum.Title
+	}
+}
+
+// decodeForumCursor returns the sort value and the slug a page continues
+// after; with no cursor the slug is empty and the value the zero of its type.
+func decodeForumCursor(sort, encoded string) (interface{}, string, error) {
+	switch sort {
+	case "threads", "posts":
+		var value int64
+		slug, err := decodeCursor(encoded, sort, &value)
+		return value, slug, err
+	case "activity":
+		var value time.Time
+		slug, err := decodeCursor(encoded, sort, &value)
+		return value, slug, err
+	default:
+		var value string
+		slug, err := decodeCursor(encoded, sort, &value)
+		return value, slug, err
+	}
+}
+
+func ListForums(ctx *fasthttp.RequestCtx) {
+	queryParams := ctx.QueryArgs()
+
+	limitParam := string(queryParams.Peek("limit"))
+	limit := 100
+	var err error
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
 			return
 		}
-		ctx.SetStatusCode(http.StatusOK)
+	}
+
+	sort := string(queryParams.Peek("sort"))
+	if sort == "" {
+		sort = "title"
+	}
+	if _, ok := forumDirectorySorts[sort]; !ok {
+		ctx.SetStatusCode(http.StatusBadRequest)
 		ctx.SetContentType("application/json")
-		ctx.SetBody([]byte("[]"))
+		ctx.SetBody(jsonToMessage("Unknown sort " + sort))
 		return
 	}
 
-	body, err := json.Marshal(users)
+	desc := string(queryParams.Peek("desc")) == "true"
+	owner := string(queryParams.Peek("owner"))
+
+	afterValue, afterSlug, err := decodeForumCursor(sort, string(queryParams.Peek("cursor")))
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Invalid cursor"))
+		return
+	}
+
+	// One forum past the page tells whether there is a next one.
+	limit = listLimit(limit)
+	forums, err := SelectForumDirectory(ctx, owner, sort, afterValue, afterSlug, limit+1, desc)
 	if err != nil {
 		log.Println(err)
+		ctx.SetStatusCode(http.StatusInternalServerError)
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	if len(forums) > limit {
+		forums = forums[:limit]
+		last := forums[limit-1]
+		next, err := encodeCursor(sort, forumSortValue(sort, last), last.Slug)
+		if err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		ctx.Response.Header.Set("X-Next-Cursor", next)
+	}
+
+	writeJSON(ctx, http.StatusOK, models.Forums(forums))
 }
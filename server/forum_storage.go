@@ -1,40 +1,234 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"forum_dbms/models"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	insertForumStmt = statement("insertForum", `INSERT INTO forums(slug, title, username) VALUES ($1, $2, $3) RETURNING `+forumColumns+`;`)
+
+	selectForumStmt = statement("selectForum", `SELECT `+forumColumns+` FROM forums WHERE LOWER(slug)=LOWER($1) LIMIT 1;`)
+
+	selectCountersStmt = statement("selectCounters", `SELECT COALESCE(SUM(value) FILTER (WHERE name = 'users'), 0)::bigint,
+		COALESCE(SUM(value) FILTER (WHERE name = 'forums'), 0)::bigint,
+		COALESCE(SUM(value) FILTER (WHERE name = 'threads'), 0)::bigint,
+		COALESCE(SUM(value) FILTER (WHERE name = 'posts'), 0)::bigint FROM counters;`)
+
+	deleteCountersStmt = statement("deleteCounters", `DELETE FROM counters;`)
+
+	countRowsStmt = statement("countRows", `INSERT INTO counters (name, slot, value) VALUES
+		('users', 0, (SELECT COUNT(*) FROM users)), ('forums', 0, (SELECT COUNT(*) FROM forums)),
+		('threads', 0, (SELECT COUNT(*) FROM threads)), ('posts', 0, (SELECT COUNT(*) FROM posts));`)
+
+	notifyAllStmt = statement("notifyAll", `SELECT pg_notify($1, '*');`)
+
+	selectUserForumsDescSinceStmt = statement("selectUserForumsDescSince", `SELECT `+forumColumns+` FROM forums
+		WHERE slug IN (SELECT slug FROM users_forum WHERE nickname = $1) AND slug < $2 ORDER BY slug DESC LIMIT NULLIF($3, 0);`)
+
+	selectUserForumsDescStmt = statement("selectUserForumsDesc", `SELECT `+forumColumns+` FROM forums
+		WHERE slug IN (SELECT slug FROM users_forum WHERE nickname = $1) ORDER BY slug DESC LIMIT NULLIF($2, 0);`)
+
+	selectUserForumsSinceStmt = statement("selectUserForumsSince", `SELECT `+forumColumns+` FROM forums
+		WHERE slug IN (SELECT slug FROM users_forum WHERE nickname = $1) AND slug > $2 ORDER BY slug LIMIT NULLIF($3, 0);`)
 )
 
-func InsertForum(forum models.Forum) (models.Forum, error) {
+// forumDirectorySorts maps every sort of the forum directory to the column it
+// orders by. slug breaks ties, so a page always ends at a distinct position.
+var forumDirectorySorts = map[string]string{
+	"title":    "title",
+	"threads":  "threads",
+	"posts":    "posts",
+	"activity": "last_activity",
+}
+
+// forumDirectoryStmts holds the ascending and the descending listing for every
+// sort. $1 filters by owner and ($3, $2) is the position to continue after;
+// both are skipped when empty.
+var forumDirectoryStmts = func() map[string][2]string {
+	stmts := make(map[string][2]string, len(forumDirectorySorts))
+	for sort, column := range forumDirectorySorts {
+		stmts[sort] = [2]string{
+			statement("selectForumDirectory_"+sort, fmt.Sprintf(`SELECT `+forumColumns+` FROM forums
+				WHERE ($1::citext = '' OR username = $1) AND ($2::citext = '' OR (%[1]s, slug) > ($3, $2))
+				ORDER BY %[1]s, slug LIMIT NULLIF($4, 0);`, column)),
+			statement("selectForumDirectoryDesc_"+sort, fmt.Sprintf(`SELECT `+forumColumns+` FROM forums
+				WHERE ($1::citext = '' OR username = $1) AND ($2::citext = '' OR (%[1]s, slug) < ($3, $2))
+				ORDER BY %[1]s DESC, slug DESC LIMIT NULLIF($4, 0);`, column)),
+		}
+	}
+	return stmts
+}()
+
+func InsertForum(ctx context.Context, forum models.Forum) (models.Forum, error) {
 	var f models.Forum
-	user, err := SelectUserByNickname(forum.User)
+	user, err := SelectUserByNickname(ctx, forum.User)
 	if err != nil {
 		return f, err
 	}
-	row := models.DB.QueryRow(`INSERT INTO forums(slug, title, username) VALUES ($1, $2, $3) RETURNING *;`,
-		forum.Slug, forum.Title, user.Nickname)
 
-	err = row.Scan(&f.User, &f.Posts, &f.Threads, &f.Slug, &f.Title)
-	return f, err
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return f, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, stmt(insertForumStmt), forum.Slug, forum.Title, user.Nickname)
+
+	f, err = scanForum(row)
+	if err != nil {
+		return f, err
+	}
+
+	err = AppendEvent(ctx, tx, models.EventForumCreated, f.Slug, f)
+	if err != nil {
+		return f, err
+	}
+
+	err = storeIdempotentResult(ctx, tx, f)
+	if err != nil {
+		return f, err
+	}
+
+	return f, tx.Commit(ctx)
 }
 
-func SelectForum(slug string) (models.Forum, error) {
-	row := models.DB.QueryRow(`SELECT * FROM forums WHERE LOWER(slug)=LOWER($1) LIMIT 1;`, slug)
-	var f models.Forum
-	err := row.Scan(&f.User, &f.Posts, &f.Threads, &f.Slug, &f.Title)
+func SelectForum(ctx context.Context, slug string) (models.Forum, error) {
+	if cached, ok := forumCache.get(forumCacheKey(slug)); ok {
+		return cached.(models.Forum), nil
+	}
+
+	row := models.DB.QueryRow(ctx, stmt(selectForumStmt), slug)
+	f, err := scanForum(row)
+	if err == nil {
+		forumCache.set(forumCacheKey(f.Slug), f)
+	}
 	return f, err
 }
 
-func StatusForum() models.Status {
+// SelectForumDirectory lists every forum, or those of one owner, in the given
+// sort. A page continues after the forum at afterSlug, whose sort column holds
+// afterValue.
+func SelectForumDirectory(ctx context.Context, owner, sort string, afterValue interface{}, afterSlug string,
+	limit int, desc bool) ([]models.Forum, error) {
+	directionStmt := 0
+	if desc {
+		directionStmt = 1
+	}
+
+	rows, err := readDB(ctx).Query(ctx, stmt(forumDirectoryStmts[sort][directionStmt]), owner, afterSlug, afterValue, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	forums := make([]models.Forum, 0, limit)
+	for rows.Next() {
+		f, err := scanForum(rows)
+		if err != nil {
+			return nil, err
+		}
+		forums = append(forums, f)
+	}
+	return forums, rows.Err()
+}
+
+// SelectForumsByUser lists the forums a user has started a thread or posted
+// in, by slug.
+func SelectForumsByUser(ctx context.Context, nickname, since string, limit int, desc bool, fn func(models.Forum) error) error {
+	var rows pgx.Rows
+	var err error
+
+	if desc {
+		if since != "" {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserForumsDescSinceStmt), nickname, since, limit)
+		} else {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserForumsDescStmt), nickname, limit)
+		}
+	} else {
+		rows, err = readDB(ctx).Query(ctx, stmt(selectUserForumsSinceStmt), nickname, since, limit)
+	}
+
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanForum(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// StatusForum reads the row counts kept in the counters table.
+func StatusForum(ctx context.Context) (models.Status, error) {
+	return scanStatus(readDB(ctx).QueryRow(ctx, stmt(selectCountersStmt)))
+}
+
+// ReconcileCounters replaces the counters with exact row counts and returns
+// them along with the values they replaced. Writes to the counted tables wait
+// until it is done.
+func ReconcileCounters(ctx context.Context) (models.Status, models.Status, error) {
+	var before, after models.Status
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return before, after, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `LOCK TABLE users, forums, threads, posts IN SHARE MODE;`)
+	if err != nil {
+		return before, after, err
+	}
+
+	before, err = scanStatus(tx.QueryRow(ctx, stmt(selectCountersStmt)))
+	if err != nil {
+		return before, after, err
+	}
+
+	_, err = tx.Exec(ctx, stmt(deleteCountersStmt))
+	if err != nil {
+		return before, after, err
+	}
+
+	_, err = tx.Exec(ctx, stmt(countRowsStmt))
+	if err != nil {
+		return before, after, err
+	}
+
+	after, err = scanStatus(tx.QueryRow(ctx, stmt(selectCountersStmt)))
+	if err != nil {
+		return before, after, err
+	}
+
+	return before, after, tx.Commit(ctx)
+}
+
+func scanStatus(row pgx.Row) (models.Status, error) {
 	var status models.Status
-	models.DB.QueryRow(`SELECT COUNT(*) FROM users;`).Scan(&status.User)
-	models.DB.QueryRow(`SELECT COUNT(*) FROM forums;`).Scan(&status.Forum)
-	models.DB.QueryRow(`SELECT COUNT(*) FROM threads;`).Scan(&status.Thread)
-	models.DB.QueryRow(`SELECT COUNT(*) FROM posts;`).Scan(&status.Post)
-	return status
+	err := row.Scan(&status.User, &status.Forum, &status.Thread, &status.Post)
+	return status, err
 }
 
-func ClearDB() error {
+func ClearDB(ctx context.Context) error {
 	var err error
-	_, err = models.DB.Exec(`TRUNCATE users, forums, threads, posts, votes, users_forum;`)
+	_, err = models.DB.Exec(ctx, `TRUNCATE users, forums, threads, posts, votes, users_forum, webhooks, webhook_outbox, events,
+		import_jobs, import_errors, import_users, import_forums, import_threads, import_posts, import_votes,
+		idempotency_keys, counters, thread_trending;`)
+	if err != nil {
+		return err
+	}
+
+	purgeCaches()
+	_, err = models.DB.Exec(ctx, stmt(notifyAllStmt), cacheChannel)
 	return err
 }
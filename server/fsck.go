@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+)
+
+const (
+	fsckForumBatch   = 100
+	fsckThreadBatch  = 1000
+	fsckDetailsLimit = 1000
+)
+
+// Fsck recomputes forums.posts, forums.threads, threads.votes, threads.posts,
+// threads.last_post_at and users_forum from the rows they are derived from and
+// reports every value that is off. With repair it also fixes them, one short
+// transaction per batch of forums or threads. The status counters are only
+// checked: reconcile rewrites them.
+func Fsck(ctx context.Context, repair bool) (models.FsckReport, error) {
+	report := models.FsckReport{Repaired: repair, Details: []models.FsckIssue{}}
+
+	slug := ""
+	for {
+		slugs, issues, err := fsckForums(ctx, slug, fsckForumBatch, repair)
+		if err != nil {
+			return report, err
+		}
+		report.Forums += len(slugs)
+		addFsckIssues(&report, issues)
+		if len(slugs) < fsckForumBatch {
+			break
+		}
+		slug = slugs[len(slugs)-1]
+	}
+
+	id := 0
+	for {
+		ids, issues, err := fsckThreads(ctx, id, fsckThreadBatch, repair)
+		if err != nil {
+			return report, err
+		}
+		report.Threads += len(ids)
+		addFsckIssues(&report, issues)
+		if len(ids) < fsckThreadBatch {
+			break
+		}
+		id = ids[len(ids)-1]
+	}
+
+	issues, err := fsckCounters(ctx)
+	if err != nil {
+		return report, err
+	}
+	addFsckIssues(&report, issues)
+
+	return report, nil
+}
+
+// addFsckIssues counts every issue but keeps only the first fsckDetailsLimit,
+// so a badly drifted database still gives a readable report.
+func addFsckIssues(report *models.FsckReport, issues []models.FsckIssue) {
+	report.Issues += len(issues)
+	for _, issue := range issues {
+		if len(report.Details) == fsckDetailsLimit {
+			return
+		}
+		report.Details = append(report.Details, issue)
+	}
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"forum_dbms/models"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Every check below takes $1, the batch: forum slugs or thread ids.
+
+// fsckForumCounts recomputes posts and threads for every forum in the batch.
+// Posts are counted through their thread, which is how they are indexed.
+const fsckForumCounts = `SELECT f.slug, f.posts, c.posts AS expected_posts, f.threads, c.threads AS expected_threads
+	FROM unnest($1::text[]) s JOIN forums f ON f.slug = s::citext,
+	LATERAL (SELECT COUNT(*) AS threads, COALESCE(SUM(n), 0)::bigint AS posts FROM (
+		SELECT (SELECT COUNT(*) FROM posts p WHERE p.thread = t.id) AS n
+		FROM threads t WHERE lower(t.forum) = lower(f.slug)) per_thread) c
+	WHERE f.posts <> c.posts OR f.threads <> c.threads`
+
+// fsckUsersForum is who should be in users_forum for the forums in the batch:
+// everyone who started a thread or wrote a post there.
+const fsckUsersForum = `WITH batch AS (SELECT s::citext AS slug FROM unnest($1::text[]) s),
+	expected AS (
+		SELECT t.forum AS slug, t.author AS nickname FROM batch b JOIN threads t ON lower(t.forum) = lower(b.slug)
+		UNION
+		SELECT t.forum, p.author FROM batch b JOIN threads t ON lower(t.forum) = lower(b.slug) JOIN posts p ON p.thread = t.id
+	)`
+
+var (
+	selectForumBatchStmt = statement("selectForumBatch", `SELECT slug FROM forums WHERE slug > $1 ORDER BY slug LIMIT $2;`)
+
+	lockForumBatchStmt = statement("lockForumBatch", `SELECT slug FROM forums WHERE slug > $1 ORDER BY slug LIMIT $2 FOR UPDATE;`)
+
+	checkForumCountsStmt = statement("checkForumCounts", fsckForumCounts+`;`)
+
+	repairForumCountsStmt = statement("repairForumCounts", `UPDATE forums f SET posts = c.expected_posts, threads = c.expected_threads
+		FROM (`+fsckForumCounts+`) c WHERE f.slug = c.slug;`)
+
+	checkUsersForumStmt = statement("checkUsersForum", fsckUsersForum+`
+		SELECT 'users_forum.missing', e.slug, e.nickname FROM expected e
+			WHERE NOT EXISTS (SELECT 1 FROM users_forum uf WHERE uf.slug = e.slug AND uf.nickname = e.nickname COLLATE "C")
+		UNION ALL
+		SELECT 'users_forum.extra', uf.slug, uf.nickname FROM batch b JOIN users_forum uf ON uf.slug = b.slug
+			WHERE NOT EXISTS (SELECT 1 FROM expected e WHERE e.slug = uf.slug AND e.nickname COLLATE "C" = uf.nickname)
+		UNION ALL
+		SELECT 'users_forum.stale', uf.slug, uf.nickname FROM batch b JOIN users_forum uf ON uf.slug = b.slug
+			JOIN users u ON u.nickname COLLATE "C" = uf.nickname
+			WHERE (uf.fullname, uf.about, uf.email) IS DISTINCT FROM (u.fullname, u.about, u.email);`)
+
+	insertMissingUsersForumStmt = statement("insertMissingUsersForum", fsckUsersForum+`
+		INSERT INTO users_forum (nickname, fullname, about, email, slug)
+		SELECT u.nickname, u.fullname, u.about, u.email, f.slug FROM expected e
+			JOIN users u ON u.nickname = e.nickname JOIN forums f ON f.slug = e.slug
+		ON CONFLICT DO NOTHING;`)
+
+	deleteExtraUsersForumStmt = statement("deleteExtraUsersForum", fsckUsersForum+`
+		DELETE FROM users_forum uf USING batch b WHERE uf.slug = b.slug
+			AND NOT EXISTS (SELECT 1 FROM expected e WHERE e.slug = uf.slug AND e.nickname COLLATE "C" = uf.nickname);`)
+
+	updateStaleUsersForumStmt = statement("updateStaleUsersForum", `UPDATE users_forum uf
+		SET fullname = u.fullname, about = u.about, email = u.email
+		FROM unnest($1::text[]) s, users u
+		WHERE uf.slug = s::citext AND u.nickname COLLATE "C" = uf.nickname
+			AND (uf.fullname, uf.about, uf.email) IS DISTINCT FROM (u.fullname, u.about, u.email);`)
+
+	selectThreadBatchStmt = statement("selectThreadBatch", `SELECT id FROM threads WHERE id > $1 ORDER BY id LIMIT $2;`)
+
+	lockThreadBatchStmt = statement("lockThreadBatch", `SELECT id FROM threads WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE;`)
+
+	checkThreadsStmt = statement("checkThreads", `SELECT t.id, t.forum, t.votes, COALESCE(v.votes, 0), t.posts, p.posts,
+		t.last_post_at IS NOT DISTINCT FROM GREATEST(t.created, p.last)
+		FROM threads t LEFT JOIN (SELECT thread, SUM(voice)::int AS votes FROM votes WHERE thread = ANY($1::int[]) GROUP BY thread) v
+			ON v.thread = t.id,
+		LATERAL (SELECT COUNT(*)::int AS posts, MAX(created) AS last FROM posts WHERE thread = t.id) p
+		WHERE t.id = ANY($1::int[]) AND (t.votes <> COALESCE(v.votes, 0) OR t.posts <> p.posts
+			OR t.last_post_at IS DISTINCT FROM GREATEST(t.created, p.last));`)
+
+	repairThreadsStmt = statement("repairThreads", `UPDATE threads t
+		SET votes = COALESCE((SELECT SUM(voice) FROM votes v WHERE v.thread = t.id), 0),
+			posts = (SELECT COUNT(*) FROM posts p WHERE p.thread = t.id),
+			last_post_at = GREATEST(t.created, (SELECT MAX(created) FROM posts p WHERE p.thread = t.id))
+		WHERE t.id = ANY($1::int[]);`)
+
+	checkCountersStmt = statement("checkCounters", `SELECT n.name, COALESCE((SELECT SUM(value) FROM counters c WHERE c.name = n.name), 0)::bigint, n.exact
+		FROM (VALUES ('users', (SELECT COUNT(*) FROM users)), ('forums', (SELECT COUNT(*) FROM forums)),
+			('threads', (SELECT COUNT(*) FROM threads)), ('posts', (SELECT COUNT(*) FROM posts))) n(name, exact);`)
+)
+
+// fsckForums checks, and with repair fixes, the forums after the given slug.
+// With repair the batch is locked first, so concurrent posts and threads in
+// those forums wait for it instead of racing the recount.
+func fsckForums(ctx context.Context, after string, limit int, repair bool) ([]string, []models.FsckIssue, error) {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	batchStmt := selectForumBatchStmt
+	if repair {
+		batchStmt = lockForumBatchStmt
+	}
+
+	rows, err := tx.Query(ctx, stmt(batchStmt), after, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var slugs []string
+	for rows.Next() {
+		var slug string
+		err = rows.Scan(&slug)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(slugs) == 0 {
+		return slugs, nil, err
+	}
+
+	slugArray, err := textArray(slugs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var issues []models.FsckIssue
+	var cacheKeys []string
+	rows, err = tx.Query(ctx, stmt(checkForumCountsStmt), slugArray)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var slug string
+		var posts, expectedPosts, threads, expectedThreads int64
+		err = rows.Scan(&slug, &posts, &expectedPosts, &threads, &expectedThreads)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if posts != expectedPosts {
+			issues = append(issues, fsckCount("forum.posts", expectedPosts, posts, models.FsckIssue{Forum: slug}))
+		}
+		if threads != expectedThreads {
+			issues = append(issues, fsckCount("forum.threads", expectedThreads, threads, models.FsckIssue{Forum: slug}))
+		}
+		cacheKeys = append(cacheKeys, forumCacheKey(slug))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	usersForumDrift := false
+	rows, err = tx.Query(ctx, stmt(checkUsersForumStmt), slugArray)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var issue models.FsckIssue
+		err = rows.Scan(&issue.Check, &issue.Forum, &issue.Nickname)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		issues = append(issues, issue)
+		usersForumDrift = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if !repair || len(issues) == 0 {
+		return slugs, issues, nil
+	}
+
+	if len(cacheKeys) > 0 {
+		_, err = tx.Exec(ctx, stmt(repairForumCountsStmt), slugArray)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if usersForumDrift {
+		for _, repairStmt := range []string{insertMissingUsersForumStmt, deleteExtraUsersForumStmt, updateStaleUsersForumStmt} {
+			_, err = tx.Exec(ctx, stmt(repairStmt), slugArray)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	err = invalidateCache(ctx, tx, cacheKeys...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return slugs, issues, tx.Commit(ctx)
+}
+
+// fsckThreads is fsckForums for the votes, reply counts and last post times of
+// the threads after the given id.
+func fsckThreads(ctx context.Context, after int, limit int, repair bool) ([]int, []models.FsckIssue, error) {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	batchStmt := selectThreadBatchStmt
+	if repair {
+		batchStmt = lockThreadBatchStmt
+	}
+
+	rows, err := tx.Query(ctx, stmt(batchStmt), after, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return ids, nil, err
+	}
+
+	idArray, err := intArray(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var issues []models.FsckIssue
+	var drifted []int
+	rows, err = tx.Query(ctx, stmt(checkThreadsStmt), idArray)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var thread models.FsckIssue
+		var votes, expectedVotes, posts, expectedPosts int64
+		var lastPostAtOK bool
+		err = rows.Scan(&thread.Thread, &thread.Forum, &votes, &expectedVotes, &posts, &expectedPosts, &lastPostAtOK)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if votes != expectedVotes {
+			issues = append(issues, fsckCount("thread.votes", expectedVotes, votes, thread))
+		}
+		if posts != expectedPosts {
+			issues = append(issues, fsckCount("thread.posts", expectedPosts, posts, thread))
+		}
+		if !lastPostAtOK {
+			thread.Check = "thread.last_post_at"
+			issues = append(issues, thread)
+		}
+		drifted = append(drifted, thread.Thread)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if !repair || len(drifted) == 0 {
+		return ids, issues, nil
+	}
+
+	driftedArray, err := intArray(drifted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = tx.Exec(ctx, stmt(repairThreadsStmt), driftedArray)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cacheKeys := make([]string, 0, len(drifted))
+	for _, id := range drifted {
+		cacheKeys = append(cacheKeys, threadCacheKey(id))
+	}
+	err = invalidateCache(ctx, tx, cacheKeys...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ids, issues, tx.Commit(ctx)
+}
+
+// fsckCounters compares the status counters with exact counts taken from the
+// same snapshot. It never repairs them, that is what reconcile is for.
+func fsckCounters(ctx context.Context) ([]models.FsckIssue, error) {
+	tx, err := models.DB.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, stmt(checkCountersStmt))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issues []models.FsckIssue
+	for rows.Next() {
+		var name string
+		var value, exact int64
+		err = rows.Scan(&name, &value, &exact)
+		if err != nil {
+			return nil, err
+		}
+		if value != exact {
+			issues = append(issues, fsckCount("counters."+name, exact, value, models.FsckIssue{}))
+		}
+	}
+	return issues, rows.Err()
+}
+
+func fsckCount(check string, expected, actual int64, issue models.FsckIssue) models.FsckIssue {
+	issue.Check = check
+	issue.Expected = models.JsonNullInt64{NullInt64: sql.NullInt64{Int64: expected, Valid: true}}
+	issue.Actual = models.JsonNullInt64{NullInt64: sql.NullInt64{Int64: actual, Valid: true}}
+	return issue
+}
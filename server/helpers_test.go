@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/valyala/fasthttp"
+)
+
+// testDB connects models.DB to the database in FORUM_TEST_DB, which must have
+// storage/migrations/up.sql applied, and empties it. Without the variable the
+// test is skipped, so go test passes on machines without Postgres.
+func testDB(t testing.TB) context.Context {
+	connString := os.Getenv("FORUM_TEST_DB")
+	if connString == "" {
+		t.Skip("FORUM_TEST_DB is not set")
+	}
+
+	ctx := context.Background()
+	if models.DB == nil {
+		config, err := pgxpool.ParseConfig(connString)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.ConnConfig.PreferSimpleProtocol = true
+		models.DB, err = pgxpool.ConnectConfig(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := ClearDB(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func testUser(t testing.TB, ctx context.Context, nickname string) models.User {
+	user, err := InsertUser(ctx, models.User{
+		Nickname: nickname,
+		Fullname: "Test " + nickname,
+		About:    "about " + nickname,
+		Email:    nickname + "@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func testForum(t testing.TB, ctx context.Context, slug, owner string) models.Forum {
+	forum, err := InsertForum(ctx, models.Forum{Slug: slug, Title: "Forum " + slug, User: owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forum
+}
+
+func testThread(t testing.TB, ctx context.Context, forum, author string, created time.Time) models.Thread {
+	thread, err := InsertThread(ctx, models.Thread{
+		Author:  author,
+		Forum:   forum,
+		Title:   "Thread by " + author,
+		Message: "message",
+		Created: created,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thread
+}
+
+// testRequest builds the RequestCtx a route handler sees, with the router's
+// path parameters already set.
+func testRequest(method, uri, body string, params map[string]string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.SetBodyString(body)
+
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	for name, value := range params {
+		ctx.SetUserValue(name, value)
+	}
+	return &ctx
+}
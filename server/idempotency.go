@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyHeader       = "Idempotency-Key"
+	idempotencyMaxKeyLength = 255
+	idempotencyLease        = time.Minute
+	idempotencyCleanupEvery = time.Minute
+)
+
+// IdempotencyWindow is how long a response is kept for replay.
+var IdempotencyWindow = 24 * time.Hour
+
+// Idempotent makes a create handler safe to retry. A request carrying an
+// Idempotency-Key runs once; later requests from the same client with the same
+// key and body get the stored response back instead of creating anything
+// again. status is what handler answers when its write succeeds; that answer
+// is stored in the write's own transaction.
+func Idempotent(status int, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		key := string(ctx.Request.Header.Peek(idempotencyHeader))
+		if key == "" {
+			handler(ctx)
+			return
+		}
+
+		if len(key) > idempotencyMaxKeyLength {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Idempotency key is too long"))
+			return
+		}
+
+		claim := &idempotencyClaim{
+			Client: idempotencyClient(ctx),
+			Key:    key,
+			Route:  string(ctx.Method()) + " " + string(ctx.Path()),
+			Status: status,
+		}
+		sum := sha256.Sum256(ctx.Request.Body())
+		hash := hex.EncodeToString(sum[:])
+
+		claimed, err := ClaimIdempotencyKey(ctx, claim, hash, idempotencyLease, IdempotencyWindow)
+		if err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Can't check idempotency key"))
+			return
+		}
+
+		if !claimed {
+			replayIdempotent(ctx, claim, hash)
+			return
+		}
+
+		ctx.SetUserValue(idempotencyClaimKey, claim)
+		handler(ctx)
+
+		answered := ctx.Response.StatusCode()
+		switch {
+		case claim.Stored && answered == claim.Status:
+			// The write's transaction already saved the response.
+		case replayable(ctx):
+			err = CompleteIdempotencyKey(ctx, claim, answered, string(ctx.Response.Header.ContentType()),
+				string(ctx.Response.Body()))
+		default:
+			// Server errors, and handlers that gave up without an answer, are
+			// not worth replaying: let the client retry for real.
+			err = ReleaseIdempotencyKey(ctx, claim)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// replayable reports whether the response is an answer the handler chose: a
+// client error, or a success with a body. An empty 200 is what fasthttp sends
+// when a handler returns without setting anything.
+func replayable(ctx *fasthttp.RequestCtx) bool {
+	status := ctx.Response.StatusCode()
+	switch {
+	case status >= http.StatusBadRequest && status < http.StatusInternalServerError:
+		return true
+	case status >= http.StatusOK && status < http.StatusMultipleChoices:
+		return len(ctx.Response.Body()) > 0
+	}
+	return false
+}
+
+// idempotencyClient scopes keys to whoever sent them, so one client can't
+// replay, or block, another's requests by guessing its keys. The API has no
+// accounts: clients are told apart by their Authorization header, if any,
+// and otherwise by address.
+func idempotencyClient(ctx *fasthttp.RequestCtx) string {
+	if auth := ctx.Request.Header.Peek("Authorization"); len(auth) > 0 {
+		sum := sha256.Sum256(auth)
+		return "auth:" + hex.EncodeToString(sum[:])
+	}
+	return "ip:" + ctx.RemoteIP().String()
+}
+
+func replayIdempotent(ctx *fasthttp.RequestCtx, claim *idempotencyClaim, hash string) {
+	record, err := SelectIdempotencyKey(ctx, claim)
+	if err != nil {
+		log.Println(err)
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't check idempotency key"))
+		return
+	}
+
+	if record.RequestHash != hash {
+		ctx.SetStatusCode(http.StatusUnprocessableEntity)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Idempotency key was already used for a different request"))
+		return
+	}
+
+	if record.Status == 0 {
+		ctx.Response.Header.Set("Retry-After", "1")
+		ctx.SetStatusCode(http.StatusConflict)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("A request with this idempotency key is still in progress"))
+		return
+	}
+
+	ctx.Response.Header.Set("Idempotent-Replayed", "true")
+	ctx.SetStatusCode(record.Status)
+	ctx.SetContentType(record.ContentType)
+	ctx.SetBody([]byte(record.Body))
+}
+
+// RunIdempotencyCleanup deletes expired keys until the process exits.
+func RunIdempotencyCleanup() {
+	ticker := time.NewTicker(idempotencyCleanupEvery)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := DeleteExpiredIdempotencyKeys(context.Background())
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
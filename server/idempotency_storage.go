@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/mailru/easyjson"
+)
+
+var (
+	claimIdempotencyKeyStmt = statement("claimIdempotencyKey", `INSERT INTO idempotency_keys(client, key, route, request_hash, locked_until, expires)
+		VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5), now() + make_interval(secs => $6))
+		ON CONFLICT (client, key, route) DO UPDATE SET request_hash = EXCLUDED.request_hash, status = NULL,
+			content_type = NULL, body = NULL, locked_until = EXCLUDED.locked_until, created = now(),
+			expires = EXCLUDED.expires
+		WHERE idempotency_keys.expires < now()
+			OR (idempotency_keys.status IS NULL AND idempotency_keys.locked_until < now())
+		RETURNING true;`)
+
+	selectIdempotencyKeyStmt = statement("selectIdempotencyKey", `SELECT request_hash, COALESCE(status, 0), COALESCE(content_type, ''), COALESCE(body, '')
+		FROM idempotency_keys WHERE client = $1 AND key = $2 AND route = $3;`)
+
+	completeIdempotencyKeyStmt = statement("completeIdempotencyKey", `UPDATE idempotency_keys SET status = $4, content_type = $5, body = $6
+		WHERE client = $1 AND key = $2 AND route = $3;`)
+
+	releaseIdempotencyKeyStmt = statement("releaseIdempotencyKey", `DELETE FROM idempotency_keys WHERE client = $1 AND key = $2 AND route = $3;`)
+
+	deleteExpiredIdempotencyKeysStmt = statement("deleteExpiredIdempotencyKeys", `DELETE FROM idempotency_keys WHERE expires < now();`)
+)
+
+// idempotencyClaim is the key a request owns. Idempotent keeps it in the
+// request's user values, where the storage functions find it through ctx.
+type idempotencyClaim struct {
+	Client string
+	Key    string
+	Route  string
+	// Status is what the route answers when its write succeeds.
+	Status int
+	// Stored is set once the response was saved by the write's transaction.
+	Stored bool
+}
+
+const idempotencyClaimKey = "idempotencyClaim"
+
+// idempotencyRecord has a zero Status while its first request is running.
+type idempotencyRecord struct {
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        string
+}
+
+// ClaimIdempotencyKey records the claim's key and reports whether the caller
+// now owns it. Expired keys, and keys whose first request outlived its lease
+// without finishing, are taken over.
+func ClaimIdempotencyKey(ctx context.Context, claim *idempotencyClaim, hash string, lease, window time.Duration) (bool, error) {
+	var claimed bool
+	err := models.DB.QueryRow(ctx, stmt(claimIdempotencyKeyStmt), claim.Client, claim.Key, claim.Route, hash,
+		int64(lease/time.Second), int64(window/time.Second)).Scan(&claimed)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return claimed, err
+}
+
+func SelectIdempotencyKey(ctx context.Context, claim *idempotencyClaim) (idempotencyRecord, error) {
+	var r idempotencyRecord
+	err := models.DB.QueryRow(ctx, stmt(selectIdempotencyKeyStmt), claim.Client, claim.Key, claim.Route).
+		Scan(&r.RequestHash, &r.Status, &r.ContentType, &r.Body)
+	return r, err
+}
+
+func CompleteIdempotencyKey(ctx context.Context, claim *idempotencyClaim, status int, contentType, body string) error {
+	_, err := models.DB.Exec(ctx, stmt(completeIdempotencyKeyStmt), claim.Client, claim.Key, claim.Route, status, contentType, body)
+	return err
+}
+
+// storeIdempotentResult saves response as the answer to the request's
+// idempotency key in tx, the transaction of the write itself. A retry then
+// either finds the write and its response, or neither. Requests without a key
+// store nothing.
+func storeIdempotentResult(ctx context.Context, tx pgx.Tx, response easyjson.Marshaler) error {
+	claim, ok := ctx.Value(idempotencyClaimKey).(*idempotencyClaim)
+	if !ok {
+		return nil
+	}
+
+	body, err := easyjson.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, stmt(completeIdempotencyKeyStmt), claim.Client, claim.Key, claim.Route, claim.Status,
+		"application/json", string(body))
+	if err != nil {
+		return err
+	}
+	claim.Stored = true
+	return nil
+}
+
+func ReleaseIdempotencyKey(ctx context.Context, claim *idempotencyClaim) error {
+	_, err := models.DB.Exec(ctx, stmt(releaseIdempotencyKeyStmt), claim.Client, claim.Key, claim.Route)
+	return err
+}
+
+func DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	tag, err := models.DB.Exec(ctx, stmt(deleteExpiredIdempotencyKeysStmt))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
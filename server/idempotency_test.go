@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestReplayable(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{http.StatusCreated, `{"nickname":"a"}`, true},
+		{http.StatusConflict, `[]`, true},
+		{http.StatusNotFound, ``, true},
+		{http.StatusOK, ``, false},
+		{http.StatusInternalServerError, `{"message":"x"}`, false},
+	}
+	for _, tt := range tests {
+		ctx := testRequest(fasthttp.MethodPost, "/", "", nil)
+		ctx.SetStatusCode(tt.status)
+		ctx.SetBodyString(tt.body)
+		if got := replayable(ctx); got != tt.want {
+			t.Errorf("replayable(%d, %q) = %v, want %v", tt.status, tt.body, got, tt.want)
+		}
+	}
+}
+
+func createUserWithKey(nickname, key, auth string) *fasthttp.RequestCtx {
+	body := `{"fullname":"Test","about":"","email":"` + nickname + `@example.com"}`
+	ctx := testRequest(fasthttp.MethodPost, "/api/user/"+nickname+"/create", body, map[string]string{"username": nickname})
+	ctx.Request.Header.Set(idempotencyHeader, key)
+	if auth != "" {
+		ctx.Request.Header.Set("Authorization", auth)
+	}
+	Idempotent(http.StatusCreated, CreateUser)(ctx)
+	return ctx
+}
+
+func TestIdempotentResponseIsStoredWithTheWrite(t *testing.T) {
+	ctx := testDB(t)
+
+	first := createUserWithKey("alice", "key-1", "")
+	if status := first.Response.StatusCode(); status != http.StatusCreated {
+		t.Fatalf("first request = %d, want %d", status, http.StatusCreated)
+	}
+	claim, ok := first.UserValue(idempotencyClaimKey).(*idempotencyClaim)
+	if !ok || !claim.Stored {
+		t.Fatal("the response was not stored by the insert's transaction")
+	}
+
+	retry := createUserWithKey("alice", "key-1", "")
+	if replayed := string(retry.Response.Header.Peek("Idempotent-Replayed")); replayed != "true" {
+		t.Fatalf("retry was not replayed: %d %s", retry.Response.StatusCode(), retry.Response.Body())
+	}
+	if string(retry.Response.Body()) != string(first.Response.Body()) {
+		t.Fatalf("replayed %s, want %s", retry.Response.Body(), first.Response.Body())
+	}
+
+	record, err := SelectIdempotencyKey(ctx, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != http.StatusCreated {
+		t.Fatalf("stored status = %d, want %d", record.Status, http.StatusCreated)
+	}
+}
+
+func TestIdempotencyKeysAreScopedPerClient(t *testing.T) {
+	testDB(t)
+
+	if status := createUserWithKey("alice", "shared", "Bearer a").Response.StatusCode(); status != http.StatusCreated {
+		t.Fatalf("client a = %d, want %d", status, http.StatusCreated)
+	}
+	other := createUserWithKey("bob", "shared", "Bearer b")
+	if status := other.Response.StatusCode(); status != http.StatusCreated {
+		t.Fatalf("client b reusing a's key = %d, want %d: %s", status, http.StatusCreated, other.Response.Body())
+	}
+}
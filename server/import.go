@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"forum_dbms/models"
+	"github.com/valyala/fasthttp"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const importBatchLines = 10000
+
+// inputError is an import that failed on what the caller sent rather than in
+// the database: a stream that broke off or an archive that did not verify.
+type inputError struct {
+	error
+}
+
+func (e inputError) Unwrap() error {
+	return e.error
+}
+
+type importRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// ImportNDJSON stages every record of r under job and merges them into the
+// live tables once the stream is exhausted. Calling it again with the same job
+// and the same stream resumes after the last staged line.
+func ImportNDJSON(ctx context.Context, job string, r io.Reader) (models.ImportReport, error) {
+	return importStream(ctx, job, r, nil)
+}
+
+func importStream(ctx context.Context, job string, r io.Reader, archive *archiveVerifier) (models.ImportReport, error) {
+	report, err := BeginImportJob(ctx, job)
+	if err != nil {
+		return report, err
+	}
+	if report.Status == "merged" {
+		return report, nil
+	}
+
+	reader := bufio.NewReaderSize(r, 1<<20)
+	batch := &importBatch{lines: report.Lines}
+	var line int64
+
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			line++
+			data = bytes.TrimSpace(data)
+			if archive != nil && len(data) > 0 {
+				if err := archive.check(data); err != nil {
+					return report, rejectArchive(ctx, job, fmt.Errorf("line %d: %v", line, err))
+				}
+			}
+			if line > report.Lines {
+				stageImportLine(job, line, data, batch)
+				batch.lines = line
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, inputError{err}
+		}
+
+		if batch.size() >= importBatchLines {
+			err = StageImportBatch(ctx, job, batch)
+			if err != nil {
+				return report, err
+			}
+			batch.reset()
+		}
+	}
+
+	if batch.lines > report.Lines {
+		err = StageImportBatch(ctx, job, batch)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if archive != nil && !archive.complete {
+		return report, rejectArchive(ctx, job, errors.New("archive is truncated: trailer is missing"))
+	}
+
+	return MergeImport(ctx, job)
+}
+
+// rejectArchive discards what an archive staged before it failed to verify.
+// Its checksum covers the whole archive, so batches are checkpointed before it
+// can be checked; left staged, they would be merged by a retry of the job with
+// another archive.
+func rejectArchive(ctx context.Context, job string, err error) error {
+	if resetErr := ResetImportJob(ctx, job); resetErr != nil {
+		return resetErr
+	}
+	return inputError{err}
+}
+
+func stageImportLine(job string, line int64, data []byte, batch *importBatch) {
+	if len(data) == 0 {
+		return
+	}
+
+	err := parseImportLine(job, line, data, batch)
+	if err != nil {
+		batch.errors = append(batch.errors, []interface{}{job, line, err.Error()})
+	}
+}
+
+func parseImportLine(job string, line int64, data []byte, batch *importBatch) error {
+	var record importRecord
+	err := json.Unmarshal(data, &record)
+	if err != nil {
+		return err
+	}
+
+	switch record.Type {
+	case "header", "trailer":
+	case "user":
+		var u models.User
+		if err := json.Unmarshal(record.Data, &u); err != nil {
+			return err
+		}
+		if u.Nickname == "" || u.Fullname == "" {
+			return errors.New("user requires nickname and fullname")
+		}
+		batch.users = append(batch.users, []interface{}{job, line, u.About, nullIfEmpty(u.Email), u.Fullname, u.Nickname})
+	case "forum":
+		var f models.Forum
+		if err := json.Unmarshal(record.Data, &f); err != nil {
+			return err
+		}
+		if f.Slug == "" || f.Title == "" || f.User == "" {
+			return errors.New("forum requires slug, title and user")
+		}
+		batch.forums = append(batch.forums, []interface{}{job, line, f.Slug, f.Title, f.User})
+	case "thread":
+		var th models.Thread
+		if err := json.Unmarshal(record.Data, &th); err != nil {
+			return err
+		}
+		if th.ID <= 0 || th.Author == "" || th.Forum == "" || th.Title == "" {
+			return errors.New("thread requires id, author, forum and title")
+		}
+		batch.threads = append(batch.threads, []interface{}{job, line, th.ID, th.Author, nullIfZeroTime(th.Created),
+			th.Forum, th.Message, nullIfEmpty(th.Slug.String), th.Title, th.Votes})
+	case "post":
+		var p models.Post
+		if err := json.Unmarshal(record.Data, &p); err != nil {
+			return err
+		}
+		if p.ID <= 0 || p.Thread <= 0 || p.Author == "" {
+			return errors.New("post requires id, thread and author")
+		}
+		var parent interface{}
+		if p.Parent.Valid && p.Parent.Int64 != 0 {
+			parent = p.Parent.Int64
+		}
+		batch.posts = append(batch.posts, []interface{}{job, line, p.ID, p.Author, nullIfZeroTime(p.Created),
+			p.IsEdited, p.Message, parent, p.Thread})
+	case "vote":
+		var v archiveVote
+		if err := json.Unmarshal(record.Data, &v); err != nil {
+			return err
+		}
+		if v.Nickname == "" || v.Thread <= 0 || (v.Voice != 1 && v.Voice != -1) {
+			return errors.New("vote requires nickname, thread and a voice of 1 or -1")
+		}
+		batch.votes = append(batch.votes, []interface{}{job, line, v.Nickname, v.Voice, v.Thread})
+	default:
+		return errors.New("unknown record type " + record.Type)
+	}
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullIfZeroTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func ImportHandler(ctx *fasthttp.RequestCtx) {
+	if !isAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Only admins can import"))
+		return
+	}
+
+	job := string(ctx.QueryArgs().Peek("job"))
+	if job == "" {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Import job id is required"))
+		return
+	}
+
+	report, err := ImportNDJSON(ctx, job, requestBodyReader(ctx))
+	if err != nil {
+		importFailed(ctx, err)
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// importFailed answers an import or restore that failed: 413 past the body
+// cap, 400 for anything else wrong with what the client sent and 500 for the
+// database.
+func importFailed(ctx *fasthttp.RequestCtx, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.As(err, &inputError{}):
+		status = http.StatusBadRequest
+	default:
+		log.Println(err)
+	}
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(jsonToMessage(err.Error()))
+}
+
+// requestBodyReader reads the body of a bulk route as it arrives, up to the
+// cap LimitStream set. The server streams request bodies, but one that came in
+// whole has no stream.
+func requestBodyReader(ctx *fasthttp.RequestCtx) io.Reader {
+	var r io.Reader = bytes.NewReader(ctx.Request.Body())
+	if stream := ctx.RequestBodyStream(); stream != nil {
+		r = stream
+	}
+	if limit, ok := ctx.UserValue(streamLimitKey).(int64); ok {
+		r = &limitedReader{r: r, n: limit}
+	}
+	return r
+}
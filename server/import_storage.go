@@ -0,0 +1,389 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"forum_dbms/models"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	insertImportJobStmt = statement("insertImportJob", `INSERT INTO import_jobs(id) VALUES ($1) ON CONFLICT DO NOTHING;`)
+
+	selectImportJobStmt = statement("selectImportJob", `SELECT id, status, lines, users, forums, threads, posts FROM import_jobs WHERE id = $1;`)
+
+	countImportErrorsStmt = statement("countImportErrors", `SELECT COUNT(*) FROM import_errors WHERE job = $1;`)
+
+	selectImportErrorsStmt = statement("selectImportErrors", `SELECT line, message FROM import_errors WHERE job = $1 ORDER BY line LIMIT $2;`)
+
+	updateImportJobLinesStmt = statement("updateImportJobLines", `UPDATE import_jobs SET lines = $2, updated = now() WHERE id = $1;`)
+
+	finishImportJobStmt = statement("finishImportJob", `UPDATE import_jobs SET status = 'merged', updated = now(),
+		users = (SELECT COUNT(*) FROM import_users WHERE job = $1 AND error IS NULL),
+		forums = (SELECT COUNT(*) FROM import_forums WHERE job = $1 AND error IS NULL),
+		threads = (SELECT COUNT(*) FROM import_threads WHERE job = $1 AND error IS NULL),
+		posts = (SELECT COUNT(*) FROM import_posts WHERE job = $1 AND error IS NULL)
+		WHERE id = $1 RETURNING id, status, lines, users, forums, threads, posts;`)
+)
+
+const importErrorsLimit = 1000
+
+type importBatch struct {
+	lines   int64
+	users   [][]interface{}
+	forums  [][]interface{}
+	threads [][]interface{}
+	posts   [][]interface{}
+	votes   [][]interface{}
+	errors  [][]interface{}
+}
+
+func (b *importBatch) size() int {
+	return len(b.users) + len(b.forums) + len(b.threads) + len(b.posts) + len(b.votes) + len(b.errors)
+}
+
+func (b *importBatch) reset() {
+	b.users = b.users[:0]
+	b.forums = b.forums[:0]
+	b.threads = b.threads[:0]
+	b.posts = b.posts[:0]
+	b.votes = b.votes[:0]
+	b.errors = b.errors[:0]
+}
+
+// BeginImportJob registers the job if it is new and returns its progress so far.
+func BeginImportJob(ctx context.Context, job string) (models.ImportReport, error) {
+	var r models.ImportReport
+	_, err := models.DB.Exec(ctx, stmt(insertImportJobStmt), job)
+	if err != nil {
+		return r, err
+	}
+
+	return SelectImportJob(ctx, job)
+}
+
+func SelectImportJob(ctx context.Context, job string) (models.ImportReport, error) {
+	var r models.ImportReport
+	row := models.DB.QueryRow(ctx, stmt(selectImportJobStmt), job)
+	err := row.Scan(&r.Job, &r.Status, &r.Lines, &r.Users, &r.Forums, &r.Threads, &r.Posts)
+	if err != nil {
+		return r, err
+	}
+
+	row = models.DB.QueryRow(ctx, stmt(countImportErrorsStmt), job)
+	err = row.Scan(&r.ErrorCount)
+	if err != nil {
+		return r, err
+	}
+
+	rows, err := models.DB.Query(ctx, stmt(selectImportErrorsStmt),
+		job, importErrorsLimit)
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+
+	r.Errors = []models.ImportError{}
+	for rows.Next() {
+		var e models.ImportError
+		err = rows.Scan(&e.Line, &e.Message)
+		if err != nil {
+			return r, err
+		}
+		r.Errors = append(r.Errors, e)
+	}
+	return r, rows.Err()
+}
+
+// StageImportBatch copies parsed records into the staging tables and moves the
+// job checkpoint in one transaction, so an interrupted import resumes after the
+// last staged line.
+func StageImportBatch(ctx context.Context, job string, batch *importBatch) error {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tables := []struct {
+		name    string
+		columns []string
+		rows    [][]interface{}
+	}{
+		{"import_users", []string{"job", "line", "about", "email", "fullname", "nickname"}, batch.users},
+		{"import_forums", []string{"job", "line", "slug", "title", "username"}, batch.forums},
+		{"import_threads", []string{"job", "line", "src_id", "author", "created", "forum", "message", "slug", "title", "votes"}, batch.threads},
+		{"import_posts", []string{"job", "line", "src_id", "author", "created", "is_edited", "message", "parent", "thread"}, batch.posts},
+		{"import_votes", []string{"job", "line", "nickname", "voice", "thread"}, batch.votes},
+		{"import_errors", []string{"job", "line", "message"}, batch.errors},
+	}
+
+	for _, table := range tables {
+		if len(table.rows) == 0 {
+			continue
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{table.name}, table.columns, pgx.CopyFromRows(table.rows))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, stmt(updateImportJobLinesStmt), job, batch.lines)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// importMergeSteps move staged rows into the live tables. Triggers are off for
+// the whole merge, so ids, post paths, forum counters, users_forum
+// and the status counters are all computed here in bulk. Rows that cannot be
+// merged get an error instead.
+var importMergeSteps = statementSeries("importMerge",
+	`UPDATE import_users i SET error = 'duplicate nickname or email in import'
+	FROM (SELECT line, row_number() OVER (PARTITION BY nickname ORDER BY line) AS by_nickname,
+		row_number() OVER (PARTITION BY email ORDER BY line) AS by_email FROM import_users WHERE job = $1) d
+	WHERE i.job = $1 AND i.line = d.line AND (d.by_nickname > 1 OR (i.email IS NOT NULL AND d.by_email > 1));`,
+
+	`UPDATE import_users i SET error = 'nickname or email is already taken' WHERE i.job = $1 AND i.error IS NULL
+	AND (EXISTS (SELECT 1 FROM users u WHERE u.nickname = i.nickname) OR EXISTS (SELECT 1 FROM users u WHERE u.email = i.email));`,
+
+	`INSERT INTO users(about, email, fullname, nickname)
+	SELECT about, email, fullname, nickname FROM import_users WHERE job = $1 AND error IS NULL;`,
+
+	`UPDATE import_forums i SET error = 'duplicate forum slug in import'
+	FROM (SELECT line, row_number() OVER (PARTITION BY slug ORDER BY line) AS n FROM import_forums WHERE job = $1) d
+	WHERE i.job = $1 AND i.line = d.line AND d.n > 1;`,
+
+	`UPDATE import_forums i SET error = 'forum slug is already taken' WHERE i.job = $1 AND i.error IS NULL
+	AND EXISTS (SELECT 1 FROM forums f WHERE f.slug = i.slug);`,
+
+	`UPDATE import_forums i SET error = 'forum owner not found' WHERE i.job = $1 AND i.error IS NULL
+	AND NOT EXISTS (SELECT 1 FROM users u WHERE u.nickname = i.username);`,
+
+	`INSERT INTO forums(username, slug, title)
+	SELECT u.nickname, i.slug, i.title FROM import_forums i JOIN users u ON u.nickname = i.username
+	WHERE i.job = $1 AND i.error IS NULL;`,
+
+	`UPDATE import_threads i SET error = 'duplicate thread id or slug in import'
+	FROM (SELECT line, row_number() OVER (PARTITION BY src_id ORDER BY line) AS by_id,
+		row_number() OVER (PARTITION BY slug ORDER BY line) AS by_slug FROM import_threads WHERE job = $1) d
+	WHERE i.job = $1 AND i.line = d.line AND (d.by_id > 1 OR (i.slug IS NOT NULL AND d.by_slug > 1));`,
+
+	`UPDATE import_threads i SET error = 'thread slug is already taken' WHERE i.job = $1 AND i.error IS NULL
+	AND i.slug IS NOT NULL AND EXISTS (SELECT 1 FROM threads t WHERE t.slug = i.slug);`,
+
+	`UPDATE import_threads i SET error = 'thread author not found' WHERE i.job = $1 AND i.error IS NULL
+	AND NOT EXISTS (SELECT 1 FROM users u WHERE u.nickname = i.author);`,
+
+	`UPDATE import_threads i SET error = 'thread forum not found' WHERE i.job = $1 AND i.error IS NULL
+	AND NOT EXISTS (SELECT 1 FROM forums f WHERE f.slug = i.forum);`,
+
+	`UPDATE import_threads i SET id = n.id
+	FROM (SELECT line, nextval('threads_id_seq') AS id FROM
+		(SELECT line FROM import_threads WHERE job = $1 AND error IS NULL ORDER BY src_id) s) n
+	WHERE i.job = $1 AND i.line = n.line;`,
+
+	`INSERT INTO threads(author, created, last_post_at, forum, id, message, slug, title, votes)
+	SELECT u.nickname, COALESCE(i.created, now()), COALESCE(i.created, now()), f.slug, i.id, i.message, i.slug, i.title,
+		COALESCE(i.votes, 0)
+	FROM import_threads i JOIN users u ON u.nickname = i.author JOIN forums f ON f.slug = i.forum
+	WHERE i.job = $1 AND i.error IS NULL;`,
+
+	`UPDATE import_posts i SET error = 'duplicate post id in import'
+	FROM (SELECT line, row_number() OVER (PARTITION BY src_id ORDER BY line) AS n FROM import_posts WHERE job = $1) d
+	WHERE i.job = $1 AND i.line = d.line AND d.n > 1;`,
+
+	`UPDATE import_posts i SET error = 'post author not found' WHERE i.job = $1 AND i.error IS NULL
+	AND NOT EXISTS (SELECT 1 FROM users u WHERE u.nickname = i.author);`,
+
+	`UPDATE import_posts i SET error = 'post thread not found' WHERE i.job = $1 AND i.error IS NULL
+	AND NOT EXISTS (SELECT 1 FROM import_threads t WHERE t.job = i.job AND t.src_id = i.thread AND t.error IS NULL);`,
+
+	`UPDATE import_posts i SET id = n.id
+	FROM (SELECT line, nextval('posts_id_seq') AS id FROM
+		(SELECT line FROM import_posts WHERE job = $1 AND error IS NULL ORDER BY src_id) s) n
+	WHERE i.job = $1 AND i.line = n.line;`,
+
+	`WITH RECURSIVE tree AS (
+		SELECT line, src_id, thread, ARRAY[id] AS path FROM import_posts
+		WHERE job = $1 AND error IS NULL AND parent IS NULL
+		UNION ALL
+		SELECT c.line, c.src_id, c.thread, tree.path || c.id FROM import_posts c
+		JOIN tree ON c.parent = tree.src_id AND c.thread = tree.thread
+		WHERE c.job = $1 AND c.error IS NULL
+	)
+	UPDATE import_posts i SET path = tree.path FROM tree WHERE i.job = $1 AND i.line = tree.line;`,
+
+	`UPDATE import_posts SET error = 'parent post not found in this thread'
+	WHERE job = $1 AND error IS NULL AND path IS NULL;`,
+
+	`INSERT INTO posts(author, created, forum, id, is_edited, message, parent, thread, path)
+	SELECT u.nickname, COALESCE(i.created, now()), t.forum, i.id, COALESCE(i.is_edited, false), i.message,
+		i.path[array_length(i.path, 1) - 1], t.id, i.path
+	FROM import_posts i JOIN import_threads it ON it.job = i.job AND it.src_id = i.thread
+	JOIN threads t ON t.id = it.id JOIN users u ON u.nickname = i.author
+	WHERE i.job = $1 AND i.error IS NULL;`,
+
+	`UPDATE import_votes i SET error = 'duplicate vote in import'
+	FROM (SELECT line, row_number() OVER (PARTITION BY nickname, thread ORDER BY line) AS n FROM import_votes WHERE job = $1) d
+	WHERE i.job = $1 AND i.line = d.line AND d.n > 1;`,
+
+	`UPDATE import_votes i SET error = 'vote author not found' WHERE i.job = $1 AND i.error IS NULL
+	AND NOT EXISTS (SELECT 1 FROM users u WHERE u.nickname = i.nickname);`,
+
+	`UPDATE import_votes i SET error = 'vote thread not found' WHERE i.job = $1 AND i.error IS NULL
+	AND NOT EXISTS (SELECT 1 FROM import_threads t WHERE t.job = i.job AND t.src_id = i.thread AND t.error IS NULL);`,
+
+	// Thread records already carry their vote totals, so the rows are copied
+	// without touching threads.votes.
+	`INSERT INTO votes(nickname, voice, thread)
+	SELECT u.nickname, i.voice, t.id FROM import_votes i JOIN users u ON u.nickname = i.nickname
+	JOIN import_threads t ON t.job = i.job AND t.src_id = i.thread
+	WHERE i.job = $1 AND i.error IS NULL
+	ON CONFLICT DO NOTHING;`,
+
+	`UPDATE threads t SET posts = c.n, last_post_at = GREATEST(t.last_post_at, c.last)
+	FROM (SELECT it.id, COUNT(*) AS n, MAX(COALESCE(p.created, now())) AS last
+		FROM import_posts p JOIN import_threads it ON it.job = p.job AND it.src_id = p.thread
+		WHERE p.job = $1 AND p.error IS NULL GROUP BY it.id) c
+	WHERE t.id = c.id;`,
+
+	`UPDATE forums f SET threads = f.threads + c.n, last_activity = GREATEST(f.last_activity, c.last),
+		updated = now()
+	FROM (SELECT forum, COUNT(*) AS n, MAX(COALESCE(created, now())) AS last FROM import_threads
+		WHERE job = $1 AND error IS NULL GROUP BY forum) c
+	WHERE f.slug = c.forum;`,
+
+	`UPDATE forums f SET posts = f.posts + c.n, last_activity = GREATEST(f.last_activity, c.last),
+		updated = now()
+	FROM (SELECT t.forum, COUNT(*) AS n, MAX(COALESCE(p.created, now())) AS last
+		FROM import_posts p JOIN import_threads t ON t.job = p.job AND t.src_id = p.thread
+		WHERE p.job = $1 AND p.error IS NULL GROUP BY t.forum) c
+	WHERE f.slug = c.forum;`,
+
+	`INSERT INTO users_forum(nickname, fullname, about, email, slug)
+	SELECT DISTINCT u.nickname, u.fullname, u.about, u.email, f.slug FROM (
+		SELECT author, forum FROM import_threads WHERE job = $1 AND error IS NULL
+		UNION
+		SELECT p.author, t.forum FROM import_posts p JOIN import_threads t ON t.job = p.job AND t.src_id = p.thread
+		WHERE p.job = $1 AND p.error IS NULL
+	) a JOIN users u ON u.nickname = a.author JOIN forums f ON f.slug = a.forum
+	ON CONFLICT DO NOTHING;`,
+
+	`INSERT INTO counters(name, slot, value)
+	SELECT c.name, pg_backend_pid() % 16, c.n FROM (
+		SELECT 'users', COUNT(*) FROM import_users WHERE job = $1 AND error IS NULL
+		UNION ALL SELECT 'forums', COUNT(*) FROM import_forums WHERE job = $1 AND error IS NULL
+		UNION ALL SELECT 'threads', COUNT(*) FROM import_threads WHERE job = $1 AND error IS NULL
+		UNION ALL SELECT 'posts', COUNT(*) FROM import_posts WHERE job = $1 AND error IS NULL
+	) c(name, n)
+	ON CONFLICT (name, slot) DO UPDATE SET value = counters.value + EXCLUDED.value;`,
+
+	`INSERT INTO import_errors(job, line, message)
+	SELECT job, line, error FROM import_users WHERE job = $1 AND error IS NOT NULL
+	UNION ALL SELECT job, line, error FROM import_forums WHERE job = $1 AND error IS NOT NULL
+	UNION ALL SELECT job, line, error FROM import_threads WHERE job = $1 AND error IS NOT NULL
+	UNION ALL SELECT job, line, error FROM import_posts WHERE job = $1 AND error IS NOT NULL
+	UNION ALL SELECT job, line, error FROM import_votes WHERE job = $1 AND error IS NOT NULL;`,
+)
+
+// importCleanupSteps empty the staging tables of a merged job.
+var importCleanupSteps = statementSeries("importCleanup",
+	`DELETE FROM import_users WHERE job = $1;`,
+	`DELETE FROM import_forums WHERE job = $1;`,
+	`DELETE FROM import_threads WHERE job = $1;`,
+	`DELETE FROM import_posts WHERE job = $1;`,
+	`DELETE FROM import_votes WHERE job = $1;`,
+)
+
+// importResetSteps throw away everything a job has staged and rewind its
+// checkpoint to the first line.
+var importResetSteps = statementSeries("importReset",
+	`DELETE FROM import_users WHERE job = $1;`,
+	`DELETE FROM import_forums WHERE job = $1;`,
+	`DELETE FROM import_threads WHERE job = $1;`,
+	`DELETE FROM import_posts WHERE job = $1;`,
+	`DELETE FROM import_votes WHERE job = $1;`,
+	`DELETE FROM import_errors WHERE job = $1;`,
+	`UPDATE import_jobs SET lines = 0, updated = now() WHERE id = $1 AND status = 'staging';`,
+)
+
+// ResetImportJob discards the staged lines of a job that is not merged yet.
+func ResetImportJob(ctx context.Context, job string) error {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, step := range importResetSteps {
+		_, err = tx.Exec(ctx, stmt(step), job)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// MergeImport moves a staged job into the live tables in one transaction.
+// Triggers and foreign key checks are switched off for it with
+// session_replication_role, which only a superuser may set: the server must
+// connect as one to merge imports and restores. The Dockerfile's docker role
+// is a superuser.
+func MergeImport(ctx context.Context, job string) (models.ImportReport, error) {
+	var r models.ImportReport
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return r, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SET LOCAL session_replication_role = replica;`)
+	if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "42501" {
+		return r, errors.New("merging an import needs a superuser connection to turn triggers off")
+	}
+	if err != nil {
+		return r, err
+	}
+
+	for _, step := range importMergeSteps {
+		_, err = tx.Exec(ctx, stmt(step), job)
+		if err != nil {
+			return r, err
+		}
+	}
+
+	row := tx.QueryRow(ctx, stmt(finishImportJobStmt), job)
+	err = row.Scan(&r.Job, &r.Status, &r.Lines, &r.Users, &r.Forums, &r.Threads, &r.Posts)
+	if err != nil {
+		return r, err
+	}
+
+	for _, step := range importCleanupSteps {
+		_, err = tx.Exec(ctx, stmt(step), job)
+		if err != nil {
+			return r, err
+		}
+	}
+
+	err = AppendEvent(ctx, tx, models.EventImportMerged, job, r)
+	if err != nil {
+		return r, err
+	}
+
+	err = invalidateCache(ctx, tx, "*")
+	if err != nil {
+		return r, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return r, err
+	}
+
+	return SelectImportJob(ctx, job)
+}
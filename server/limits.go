@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"github.com/valyala/fasthttp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// MaxBodySize caps the request body of every route wrapped in LimitBody,
+	// which is all of them but bulk import and restore.
+	MaxBodySize = 16 << 20
+
+	// MaxStreamBodySize caps the streamed bodies of bulk import and restore.
+	MaxStreamBodySize int64 = 4 << 30
+
+	// MaxPostsBatch caps how many posts one create request may carry.
+	MaxPostsBatch = 10000
+
+	// MaxListLimit caps the limit of every listing, including limit=0.
+	MaxListLimit = 10000
+)
+
+var (
+	errBatchTooLarge = errors.New("batch too large")
+	errBodyTooLarge  = errors.New("request body too large")
+)
+
+const streamLimitKey = "streamLimit"
+
+// LimitBody reads the request body for handler and refuses one longer than
+// limit with 413. The server streams request bodies so that bulk routes can
+// take any size; handlers behind LimitBody see the whole body as before.
+func LimitBody(limit int, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		length := ctx.Request.Header.ContentLength()
+		if length > limit {
+			bodyTooLarge(ctx, int64(limit))
+			return
+		}
+
+		// A chunked body has no length up front, so the stream is read one
+		// byte past the limit to tell whether it fits. Reading it all also
+		// keeps an ignored body from being taken for the next request.
+		if stream := ctx.RequestBodyStream(); stream != nil {
+			body, err := ioutil.ReadAll(io.LimitReader(stream, int64(limit)+1))
+			if err != nil {
+				RequestErrorHandler(ctx, err)
+				ctx.SetConnectionClose()
+				return
+			}
+			if len(body) > limit {
+				bodyTooLarge(ctx, int64(limit))
+				return
+			}
+			ctx.Request.SetBody(body)
+		}
+
+		handler(ctx)
+	}
+}
+
+// LimitStream caps a streamed request body at limit bytes without reading it
+// up front. The handler reads it through requestBodyReader, which fails with
+// errBodyTooLarge once the body runs past the limit.
+func LimitStream(limit int64, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if int64(ctx.Request.Header.ContentLength()) > limit {
+			bodyTooLarge(ctx, limit)
+			return
+		}
+
+		ctx.SetUserValue(streamLimitKey, limit)
+		handler(ctx)
+
+		// A handler that failed may have left part of the body unread.
+		if ctx.Response.StatusCode() >= http.StatusBadRequest {
+			ctx.SetConnectionClose()
+		}
+	}
+}
+
+// limitedReader is io.LimitReader that tells a body which ends at the limit
+// from one which goes on past it.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// bodyTooLarge answers 413 and closes the connection, whose unread rest of the
+// body could not be told apart from the next request.
+func bodyTooLarge(ctx *fasthttp.RequestCtx, limit int64) {
+	ctx.SetStatusCode(http.StatusRequestEntityTooLarge)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(jsonToMessage("Request body is larger than " + strconv.FormatInt(limit, 10) + " bytes"))
+	ctx.SetConnectionClose()
+}
+
+// RequestErrorHandler answers requests fasthttp could not read in the same
+// JSON format the handlers use.
+func RequestErrorHandler(ctx *fasthttp.RequestCtx, err error) {
+	status, message := http.StatusBadRequest, "Error when parsing request"
+	if _, ok := err.(*fasthttp.ErrSmallBuffer); ok {
+		status, message = http.StatusRequestHeaderFieldsTooLarge, "Too big request header"
+	} else if netErr, ok := err.(*net.OpError); ok && netErr.Timeout() {
+		status, message = http.StatusRequestTimeout, "Request timeout"
+	}
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(jsonToMessage(message))
+}
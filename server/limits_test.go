@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// bodyServer serves echo behind LimitBody on /limited, reads the raw stream
+// on /bulk and reads it through LimitStream on /capped, the way the main
+// server mixes JSON and bulk routes.
+func bodyServer(t *testing.T, limit int) *fasthttp.Client {
+	echo := func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBody(ctx.Request.Body())
+	}
+	bulk := func(ctx *fasthttp.RequestCtx) {
+		body, err := ioutil.ReadAll(ctx.RequestBodyStream())
+		if err != nil {
+			t.Error(err)
+		}
+		ctx.SetBody(body)
+	}
+	capped := func(ctx *fasthttp.RequestCtx) {
+		body, err := ioutil.ReadAll(requestBodyReader(ctx))
+		if err != nil {
+			importFailed(ctx, inputError{err})
+			return
+		}
+		ctx.SetBody(body)
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+	srv := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			switch string(ctx.Path()) {
+			case "/bulk":
+				bulk(ctx)
+				return
+			case "/capped":
+				LimitStream(int64(limit), capped)(ctx)
+				return
+			}
+			LimitBody(limit, echo)(ctx)
+		},
+		ErrorHandler:      RequestErrorHandler,
+		StreamRequestBody: true,
+	}
+	go srv.Serve(ln) //nolint:errcheck
+	t.Cleanup(func() { ln.Close() })
+
+	return &fasthttp.Client{Dial: func(addr string) (net.Conn, error) { return ln.Dial() }}
+}
+
+func postBody(t *testing.T, client *fasthttp.Client, path, body string, chunked bool) (int, string) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI("http://forum" + path)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	if chunked {
+		req.SetBodyStream(strings.NewReader(body), -1)
+	} else {
+		req.SetBodyString(body)
+	}
+
+	err := client.Do(req, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode(), string(resp.Body())
+}
+
+func TestLimitBody(t *testing.T) {
+	const limit = 64 << 10
+	client := bodyServer(t, limit)
+	fits := strings.Repeat("a", limit)
+	tooLarge := fits + "a"
+
+	for _, chunked := range []bool{false, true} {
+		status, body := postBody(t, client, "/limited", fits, chunked)
+		if status != http.StatusOK || body != fits {
+			t.Errorf("chunked=%v: body of the limit got %d with %d bytes back", chunked, status, len(body))
+		}
+
+		status, _ = postBody(t, client, "/limited", tooLarge, chunked)
+		if status != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunked=%v: body over the limit got %d, want %d", chunked, status, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestBulkRoutesStreamPastTheLimit(t *testing.T) {
+	client := bodyServer(t, 1<<10)
+	large := string(bytes.Repeat([]byte("{}\n"), 1<<20))
+
+	for _, chunked := range []bool{false, true} {
+		status, body := postBody(t, client, "/bulk", large, chunked)
+		if status != http.StatusOK || body != large {
+			t.Errorf("chunked=%v: bulk body got %d with %d of %d bytes back", chunked, status, len(body), len(large))
+		}
+	}
+}
+
+func TestLimitStream(t *testing.T) {
+	const limit = 64 << 10
+	client := bodyServer(t, limit)
+	fits := strings.Repeat("a", limit)
+	tooLarge := fits + "a"
+
+	for _, chunked := range []bool{false, true} {
+		status, body := postBody(t, client, "/capped", fits, chunked)
+		if status != http.StatusOK || body != fits {
+			t.Errorf("chunked=%v: body of the limit got %d with %d bytes back", chunked, status, len(body))
+		}
+
+		status, _ = postBody(t, client, "/capped", tooLarge, chunked)
+		if status != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunked=%v: body over the limit got %d, want %d", chunked, status, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"forum_dbms/models"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"time"
+)
+
+func PoolStatsHandler(ctx *fasthttp.RequestCtx) {
+	stat := models.DB.Stat()
+	stats := models.PoolStats{
+		MaxConns:             stat.MaxConns(),
+		TotalConns:           stat.TotalConns(),
+		AcquiredConns:        stat.AcquiredConns(),
+		IdleConns:            stat.IdleConns(),
+		ConstructingConns:    stat.ConstructingConns(),
+		AcquireCount:         stat.AcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		AcquireDurationMs:    float64(stat.AcquireDuration()) / float64(time.Millisecond),
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -1,16 +1,17 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"forum_dbms/models"
+	"github.com/mailru/easyjson"
+	"github.com/mailru/easyjson/jlexer"
 	"github.com/valyala/fasthttp"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 )
 
 func CreatePosts(ctx *fasthttp.RequestCtx) {
@@ -27,9 +28,9 @@ func CreatePosts(ctx *fasthttp.RequestCtx) {
 	var thread models.Thread
 	switch err {
 	case nil:
-		thread, err = SelectThreadByID(slugID)
+		thread, err = SelectThreadByID(ctx, slugID)
 	default:
-		thread, err = SelectThread(slug)
+		thread, err = SelectThread(ctx, slug)
 	}
 
 	if err != nil {
@@ -39,8 +40,13 @@ func CreatePosts(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	var posts []models.Post
-	err = json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&posts)
+	posts, err := decodePosts(ctx.Request.Body(), MaxPostsBatch)
+	if err == errBatchTooLarge {
+		ctx.SetStatusCode(http.StatusRequestEntityTooLarge)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Too many posts in one request, the limit is " + strconv.Itoa(MaxPostsBatch)))
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		return
@@ -53,9 +59,9 @@ func CreatePosts(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	postsCreated, err := InsertPosts(posts, thread)
+	postsCreated, err := InsertPosts(ctx, posts, thread)
 	if err != nil {
-		if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23503" {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23503" {
 			ctx.SetStatusCode(http.StatusNotFound)
 			ctx.SetContentType("application/json")
 			ctx.SetBody(jsonToMessage("Can't find post author by nickname"))
@@ -68,15 +74,33 @@ func CreatePosts(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
-	body, err := json.Marshal(postsCreated)
-	if err != nil {
-		log.Println(err)
-		return
+	writeJSON(ctx, http.StatusCreated, models.Posts(postsCreated))
+}
+
+// decodePosts reads a JSON array of posts one element at a time, so an
+// oversized batch is refused before all of it is decoded.
+func decodePosts(body []byte, max int) ([]models.Post, error) {
+	in := jlexer.Lexer{Data: body}
+	if in.IsNull() {
+		in.Skip()
+		in.Consumed()
+		return nil, in.Error()
 	}
 
-	ctx.SetStatusCode(http.StatusCreated)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	var posts []models.Post
+	in.Delim('[')
+	for !in.IsDelim(']') && in.Ok() {
+		if len(posts) == max {
+			return nil, errBatchTooLarge
+		}
+		var post models.Post
+		post.UnmarshalEasyJSON(&in)
+		posts = append(posts, post)
+		in.WantComma()
+	}
+	in.Delim(']')
+	in.Consumed()
+	return posts, in.Error()
 }
 
 func ThreadPosts(ctx *fasthttp.RequestCtx) {
@@ -127,15 +151,10 @@ func ThreadPosts(ctx *fasthttp.RequestCtx) {
 	}
 
 	slugID, err := strconv.Atoi(slug)
-	id := 0
-	switch err {
-	case nil:
-		id = slugID
-		_, err = SelectThreadByID(id)
-	default:
-		id, err = SelectThreadID(slug)
+	if err != nil {
+		slugID = 0
 	}
-
+	thread, err := SelectListedThread(ctx, slugID, slug)
 	if err != nil {
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
@@ -143,28 +162,16 @@ func ThreadPosts(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	posts, err := SelectPosts(id, limit, since, sort, desc)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	if len(posts) == 0 {
-		ctx.SetStatusCode(http.StatusOK)
-		ctx.SetContentType("application/json")
-		ctx.SetBody([]byte("[]"))
-		return
-	}
-
-	body, err := json.Marshal(posts)
-	if err != nil {
-		log.Println(err)
+	limit = listLimit(limit)
+	if notModified(ctx, threadPostsTag(thread, limit, since, sort, desc), threadPostsModified(thread)) {
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectPosts(ctx, thread.ID, limit, since, sort, desc, func(p models.Post) error {
+			return emit(p)
+		})
+	})
 }
 
 func GetPostDetails(ctx *fasthttp.RequestCtx) {
@@ -189,7 +196,7 @@ func GetPostDetails(ctx *fasthttp.RequestCtx) {
 	relatedParam := string(queryParams.Peek("related"))
 	related := relatedParam
 
-	postFull, err := SelectPostByID(id, strings.Split(related, ","))
+	postFull, err := SelectPostByID(ctx, id, strings.Split(related, ","))
 	if err != nil {
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
@@ -197,15 +204,29 @@ func GetPostDetails(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(postFull)
-	if err != nil {
-		log.Println(err)
+	// The tag covers every entity in the response, so editing the author or
+	// the thread of a post also changes it.
+	post := postFull.Post
+	parts := []interface{}{postTag(*post)}
+	modified := post.Updated
+	if author := postFull.Author; author != nil {
+		parts = append(parts, userTag(*author))
+		modified = latest(modified, author.Updated)
+	}
+	if thread := postFull.Thread; thread != nil {
+		parts = append(parts, threadTag(*thread))
+		modified = latest(modified, thread.Updated)
+	}
+	if forum := postFull.Forum; forum != nil {
+		parts = append(parts, forumTag(*forum))
+		modified = latest(modified, forum.Updated)
+	}
+
+	if notModified(ctx, entityTag(parts...), modified) {
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, postFull)
 }
 
 func EditPostDetails(ctx *fasthttp.RequestCtx) {
@@ -226,13 +247,20 @@ func EditPostDetails(ctx *fasthttp.RequestCtx) {
 	}
 
 	var postUpdate models.PostUpdate
-	err = json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&postUpdate)
+	err = easyjson.Unmarshal(ctx.Request.Body(), &postUpdate)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	post, err := UpdatePost(postUpdate, id)
+	postUpdate.Version = expectedVersion(ctx, postUpdate.Version, func(version int64) string {
+		return postTag(models.Post{ID: id, Version: version})
+	})
+	post, err := UpdatePost(ctx, postUpdate, id)
+	if err == errVersionConflict {
+		preconditionFailed(ctx, post, postTag(post))
+		return
+	}
 	if err != nil {
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
@@ -240,13 +268,106 @@ func EditPostDetails(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(post)
+	ctx.Response.Header.Set("ETag", postTag(post))
+	writeJSON(ctx, http.StatusOK, post)
+}
+
+// postQueryInt reads an optional integer query parameter.
+func postQueryInt(ctx *fasthttp.RequestCtx, name string, fallback int) (int, error) {
+	param := string(ctx.QueryArgs().Peek(name))
+	if param == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(param)
+}
+
+func PostReplies(ctx *fasthttp.RequestCtx) {
+	postIDInterface := ctx.UserValue("postID")
+	id := 0
+
+	var err error
+	switch postIDInterface.(type) {
+	case string:
+		id, err = strconv.Atoi(postIDInterface.(string))
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	limit, err := postQueryInt(ctx, "limit", 100)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+	depth, err := postQueryInt(ctx, "depth", 0)
+	if err != nil || depth < 0 {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+	since, err := postQueryInt(ctx, "since", 0)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	post, err := SelectPost(ctx, id)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't find post by id"))
+		return
+	}
+
+	limit = listLimit(limit)
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectPostReplies(ctx, post, depth, since, limit, func(p models.Post) error {
+			return emit(p)
+		})
+	})
+}
+
+func PostContext(ctx *fasthttp.RequestCtx) {
+	postIDInterface := ctx.UserValue("postID")
+	id := 0
+
+	var err error
+	switch postIDInterface.(type) {
+	case string:
+		id, err = strconv.Atoi(postIDInterface.(string))
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	siblings, err := postQueryInt(ctx, "siblings", 5)
+	if err != nil || siblings < 0 {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+	if siblings > MaxListLimit {
+		siblings = MaxListLimit
+	}
+
+	postContext, err := SelectPostContext(ctx, id, siblings)
+	if err == pgx.ErrNoRows {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't find post by id"))
+		return
+	}
 	if err != nil {
 		log.Println(err)
+		ctx.SetStatusCode(http.StatusInternalServerError)
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, postContext)
 }
@@ -1,168 +1,515 @@
 package server
 
 import (
-	"fmt"
+	"context"
 	"forum_dbms/models"
-	"strings"
+	"strconv"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
 )
 
-func InsertPosts(posts []models.Post, thread models.Thread) ([]models.Post, error) {
+var (
+	selectPostsFlatDescStmt = statement("selectPostsFlatDesc", `SELECT `+postColumns+` FROM posts WHERE thread=$1 ORDER BY id DESC LIMIT NULLIF($2, 0);`)
+
+	selectPostsFlatStmt = statement("selectPostsFlat", `SELECT `+postColumns+` FROM posts WHERE thread=$1 ORDER BY id LIMIT NULLIF($2, 0);`)
+
+	selectPostsTreeDescStmt = statement("selectPostsTreeDesc", `SELECT `+postColumns+` FROM posts WHERE thread=$1 ORDER BY path DESC LIMIT NULLIF($2, 0);`)
+
+	selectPostsTreeStmt = statement("selectPostsTree", `SELECT `+postColumns+` FROM posts WHERE thread=$1 ORDER BY path LIMIT NULLIF($2, 0);`)
+
+	selectPostsParentTreeDescStmt = statement("selectPostsParentTreeDesc", `SELECT `+postColumns+` FROM posts WHERE path[1] IN
+		(SELECT id FROM posts WHERE thread=$1 AND parent IS NULL ORDER BY id DESC LIMIT NULLIF($2, 0))
+		ORDER BY path[1] DESC, path;`)
+
+	selectPostsParentTreeStmt = statement("selectPostsParentTree", `SELECT `+postColumns+` FROM posts WHERE path[1] IN
+		(SELECT id FROM posts WHERE thread=$1 AND parent IS NULL ORDER BY id LIMIT NULLIF($2, 0))
+		ORDER BY path;`)
+
+	selectPostsFlatSinceDescStmt = statement("selectPostsFlatSinceDesc", `SELECT `+postColumns+` FROM posts WHERE thread=$1 AND id < $2
+		ORDER BY id DESC LIMIT NULLIF($3, 0);`)
+
+	selectPostsFlatSinceStmt = statement("selectPostsFlatSince", `SELECT `+postColumns+` FROM posts WHERE thread=$1 AND id > $2
+		ORDER BY id LIMIT NULLIF($3, 0);`)
+
+	selectPostsTreeSinceDescStmt = statement("selectPostsTreeSinceDesc", `SELECT `+postColumns+` FROM posts WHERE thread=$1 AND PATH < (SELECT path FROM posts WHERE id = $2)
+		ORDER BY path DESC LIMIT NULLIF($3, 0);`)
+
+	selectPostsTreeSinceStmt = statement("selectPostsTreeSince", `SELECT `+postColumns+` FROM posts WHERE thread=$1 AND PATH > (SELECT path FROM posts WHERE id = $2)
+		ORDER BY path LIMIT NULLIF($3, 0);`)
+
+	selectPostsParentTreeSinceDescStmt = statement("selectPostsParentTreeSinceDesc", `SELECT `+postColumns+` FROM posts WHERE path[1] IN (SELECT id FROM posts WHERE thread=$1 AND parent IS NULL AND PATH[1] <
+		(SELECT path[1] FROM posts WHERE id = $2) ORDER BY id DESC LIMIT NULLIF($3, 0)) ORDER BY path[1] DESC, path;`)
+
+	selectPostsParentTreeSinceStmt = statement("selectPostsParentTreeSince", `SELECT `+postColumns+` FROM posts WHERE path[1] IN (SELECT id FROM posts WHERE thread=$1 AND parent IS NULL AND PATH[1] >
+		(SELECT path[1] FROM posts WHERE id = $2) ORDER BY id LIMIT NULLIF($3, 0)) ORDER BY path;`)
+
+	selectPostStmt = statement("selectPost", `SELECT `+postColumns+` FROM posts WHERE id = $1 LIMIT 1;`)
+
+	updatePostStmt = statement("updatePost", `UPDATE posts SET message=COALESCE(NULLIF($1, ''), message), 
+		is_edited = CASE WHEN $1 = '' OR message = $1 THEN false ELSE true END WHERE id=$2 AND ($3 = 0 OR version = $3)
+		RETURNING `+postColumns+`;`)
+
+	insertPostsStmt = statement("insertPosts", `INSERT INTO posts(author, created, forum, message, parent, thread)
+		SELECT p.author, $2, $3, p.message, p.parent, $6
+		FROM unnest($1::text[], $4::text[], $5::bigint[]) WITH ORDINALITY AS p(author, message, parent, n)
+		ORDER BY p.n RETURNING `+postColumns+`;`)
+
+	selectUserPostsBeforeStmt = statement("selectUserPostsBefore", `SELECT `+postColumns+` FROM posts WHERE LOWER(author)=LOWER($1) AND created <= $2
+		ORDER BY created DESC, id DESC LIMIT NULLIF($3, 0);`)
+
+	selectUserPostsAfterStmt = statement("selectUserPostsAfter", `SELECT `+postColumns+` FROM posts WHERE LOWER(author)=LOWER($1) AND created >= $2
+		ORDER BY created, id LIMIT NULLIF($3, 0);`)
+
+	selectUserPostsDescStmt = statement("selectUserPostsDesc", `SELECT `+postColumns+` FROM posts WHERE LOWER(author)=LOWER($1)
+		ORDER BY created DESC, id DESC LIMIT NULLIF($2, 0);`)
+
+	selectUserPostsStmt = statement("selectUserPosts", `SELECT `+postColumns+` FROM posts WHERE LOWER(author)=LOWER($1)
+		ORDER BY created, id LIMIT NULLIF($2, 0);`)
+
+	// Descendants of the post with path $2 sort between that path and the
+	// same path followed by the largest id.
+	selectPostRepliesStmt = statement("selectPostReplies", `SELECT `+postColumns+` FROM posts
+		WHERE thread=$1 AND path > $2 AND path < $2 || 9223372036854775807::bigint
+		AND ($3 = 0 OR array_length(path, 1) <= array_length($2::bigint[], 1) + $3)
+		AND ($4 = 0 OR path > (SELECT path FROM posts WHERE id = $4))
+		ORDER BY path LIMIT NULLIF($5, 0);`)
+
+	selectPostAncestorsStmt = statement("selectPostAncestors", `SELECT `+postColumns+` FROM posts WHERE id = ANY($1::bigint[]) ORDER BY path;`)
+
+	selectPostSiblingsBeforeStmt = statement("selectPostSiblingsBefore", `SELECT `+postColumns+` FROM posts WHERE parent=$1 AND id < $2
+		ORDER BY id DESC LIMIT $3;`)
+
+	selectPostSiblingsAfterStmt = statement("selectPostSiblingsAfter", `SELECT `+postColumns+` FROM posts WHERE parent=$1 AND id > $2
+		ORDER BY id LIMIT $3;`)
+
+	selectPostRootSiblingsBeforeStmt = statement("selectPostRootSiblingsBefore", `SELECT `+postColumns+` FROM posts
+		WHERE thread=$1 AND parent IS NULL AND id < $2 ORDER BY id DESC LIMIT $3;`)
+
+	selectPostRootSiblingsAfterStmt = statement("selectPostRootSiblingsAfter", `SELECT `+postColumns+` FROM posts
+		WHERE thread=$1 AND parent IS NULL AND id > $2 ORDER BY id LIMIT $3;`)
+)
+
+// postInsertChunk bounds the rows sent in one INSERT so that a huge batch does
+// not have to be encoded into a single message.
+const postInsertChunk = 10000
+
+func InsertPosts(ctx context.Context, posts []models.Post, thread models.Thread) ([]models.Post, error) {
 	var insertedPosts []models.Post
-	query := `INSERT INTO posts(author, created, forum, message, parent, thread) VALUES `
-	var values []interface{}
 	timeCreated := time.Now()
+
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Large batches go in as several statements inside the one transaction,
+	// so the batch is still created all or nothing.
+	for start := 0; start < len(posts); start += postInsertChunk {
+		end := start + postInsertChunk
+		if end > len(posts) {
+			end = len(posts)
+		}
+
+		inserted, err := insertPostsChunk(ctx, tx, posts[start:end], thread, timeCreated)
+		if err != nil {
+			return nil, err
+		}
+		insertedPosts = append(insertedPosts, inserted...)
+	}
+
+	err = AppendEvents(ctx, tx, models.EventPostCreated, "id", insertedPosts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = EnqueueWebhookEvents(ctx, tx, thread.Forum, models.EventPostCreated, insertedPosts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = invalidateCache(ctx, tx, forumCacheKey(thread.Forum), threadCacheKey(thread.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	err = storeIdempotentResult(ctx, tx, models.Posts(insertedPosts))
+	if err != nil {
+		return nil, err
+	}
+
+	return insertedPosts, tx.Commit(ctx)
+}
+
+func insertPostsChunk(ctx context.Context, tx pgx.Tx, posts []models.Post, thread models.Thread, created time.Time) ([]models.Post, error) {
+	var insertedPosts []models.Post
+	authors := make([]string, len(posts))
+	messages := make([]string, len(posts))
+	parents := make([]*int64, len(posts))
 	for i, post := range posts {
-		value := fmt.Sprintf(
-			"($%d, $%d, $%d, $%d, $%d, $%d),",
-			i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6,
-		)
+		authors[i] = post.Author
+		messages[i] = post.Message
+		if post.Parent.Valid {
+			parents[i] = &posts[i].Parent.Int64
+		}
+	}
 
-		query += value
-		values = append(values, post.Author, timeCreated, thread.Forum, post.Message, post.Parent, thread.ID)
+	var parentArray pgtype.Int8Array
+	err := parentArray.Set(parents)
+	if err != nil {
+		return nil, err
 	}
 
-	query = strings.TrimSuffix(query, ",")
-	query += ` RETURNING *`
+	authorArray, err := textArray(authors)
+	if err != nil {
+		return nil, err
+	}
+	messageArray, err := textArray(messages)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := models.DB.Query(query, values...)
+	rows, err := tx.Query(ctx, stmt(insertPostsStmt), authorArray, created, thread.Forum, messageArray,
+		parentArray, thread.ID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
 	for rows.Next() {
-		var p models.Post
-		err := rows.Scan(&p.Author, &p.Created, &p.Forum, &p.ID, &p.IsEdited, &p.Message, &p.Parent, &p.Thread, &p.Path)
+		p, err := scanPost(rows)
 		if err != nil {
+			rows.Close()
 			return nil, models.ErrConflict
 		}
 		insertedPosts = append(insertedPosts, p)
 	}
+	rows.Close()
 
-	if rows.Err() != nil {
-		return nil, rows.Err()
-	}
-	return insertedPosts, nil
+	return insertedPosts, rows.Err()
 }
 
-func SelectPosts(threadID int, limit, since int, sort string, desc bool) ([]models.Post, error) {
-	var posts []models.Post
-	var rows *pgx.Rows
+// SelectPosts hands the thread's posts to fn one at a time, in page order.
+func SelectPosts(ctx context.Context, threadID int, limit, since int, sort string, desc bool, fn func(models.Post) error) error {
+	var rows pgx.Rows
 	var err error
 
 	if since == 0 {
 		if sort == "flat" || sort == "" {
 			if desc {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 ORDER BY id DESC LIMIT NULLIF($2, 0);`, threadID, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsFlatDescStmt), threadID, limit)
 			} else {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 ORDER BY id LIMIT NULLIF($2, 0);`, threadID, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsFlatStmt), threadID, limit)
 			}
 		} else if sort == "tree" {
 			if desc {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 ORDER BY path DESC LIMIT NULLIF($2, 0);`, threadID, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsTreeDescStmt), threadID, limit)
 			} else {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 ORDER BY path LIMIT NULLIF($2, 0);`, threadID, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsTreeStmt), threadID, limit)
 			}
 		} else {
 			if desc {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE path[1] IN
-				(SELECT id FROM posts WHERE thread=$1 AND parent IS NULL ORDER BY id DESC LIMIT NULLIF($2, 0))
-				ORDER BY path[1] DESC, path;`, threadID, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsParentTreeDescStmt), threadID, limit)
 			} else {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE path[1] IN
-				(SELECT id FROM posts WHERE thread=$1 AND parent IS NULL ORDER BY id LIMIT NULLIF($2, 0))
-				ORDER BY path;`, threadID, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsParentTreeStmt), threadID, limit)
 			}
 		}
 	} else {
 		if sort == "flat" || sort == "" {
 			if desc {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 AND id < $2
-				ORDER BY id DESC LIMIT NULLIF($3, 0);`, threadID, since, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsFlatSinceDescStmt), threadID, since, limit)
 			} else {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 AND id > $2
-				ORDER BY id LIMIT NULLIF($3, 0);`, threadID, since, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsFlatSinceStmt), threadID, since, limit)
 			}
 		} else if sort == "tree" {
 			if desc {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 AND PATH < (SELECT path FROM posts WHERE id = $2)
-				ORDER BY path DESC LIMIT NULLIF($3, 0);`, threadID, since, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsTreeSinceDescStmt), threadID, since, limit)
 			} else {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE thread=$1 AND PATH > (SELECT path FROM posts WHERE id = $2)
-				ORDER BY path LIMIT NULLIF($3, 0);`, threadID, since, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsTreeSinceStmt), threadID, since, limit)
 			}
 		} else {
 			if desc {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE path[1] IN (SELECT id FROM posts WHERE thread=$1 AND parent IS NULL AND PATH[1] <
-				(SELECT path[1] FROM posts WHERE id = $2) ORDER BY id DESC LIMIT NULLIF($3, 0)) ORDER BY path[1] DESC, path;`, threadID, since, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsParentTreeSinceDescStmt), threadID, since, limit)
 			} else {
-				rows, err = models.DB.Query(`SELECT * FROM posts WHERE path[1] IN (SELECT id FROM posts WHERE thread=$1 AND parent IS NULL AND PATH[1] >
-				(SELECT path[1] FROM posts WHERE id = $2) ORDER BY id LIMIT NULLIF($3, 0)) ORDER BY path;`, threadID, since, limit)
+				rows, err = readDB(ctx).Query(ctx, stmt(selectPostsParentTreeSinceStmt), threadID, since, limit)
 			}
 		}
 	}
 
 	if err != nil {
-		return posts, err
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var p models.Post
-		err = rows.Scan(&p.Author, &p.Created, &p.Forum, &p.ID, &p.IsEdited, &p.Message, &p.Parent, &p.Thread, &p.Path)
+		p, err := scanPost(rows)
 		if err != nil {
-			return posts, err
+			return err
+		}
+		if err = fn(p); err != nil {
+			return err
 		}
-
-		posts = append(posts, p)
 	}
-	return posts, nil
+	return rows.Err()
 }
 
-func SelectPostByID(id int, related []string) (map[string]interface{}, error) {
-	var post models.Post
-	postFull := map[string]interface{}{}
+func SelectPost(ctx context.Context, id int) (models.Post, error) {
+	row := models.DB.QueryRow(ctx, stmt(selectPostStmt), id)
+	return scanPost(row)
+}
 
-	row := models.DB.QueryRow(`SELECT * FROM posts WHERE id = $1 LIMIT 1;`, id)
-	err := row.Scan(&post.Author, &post.Created, &post.Forum, &post.ID, &post.IsEdited, &post.Message, &post.Parent, &post.Thread, &post.Path)
+func SelectPostByID(ctx context.Context, id int, related []string) (models.PostFull, error) {
+	var postFull models.PostFull
+	db := readDB(ctx)
+	// Rows read from a replica may be behind the primary, so they are not cached.
+	cacheable := db == models.DB
+
+	post, err := scanPost(db.QueryRow(ctx, stmt(selectPostStmt), id))
 	if err != nil {
 		return postFull, err
 	}
-	postFull["post"] = post
+	postFull.Post = &post
 
+	// Related rows that are not cached are fetched in a single round trip.
+	batch := &pgx.Batch{}
+	var scans []func(pgx.Row) error
 	for _, param := range related {
 		switch param {
 		case "user":
-			author, err := SelectUserByNickname(post.Author)
-			if err != nil {
-				return postFull, err
+			if cached, ok := userCache.get(userCacheKey(post.Author)); ok {
+				author := cached.(models.User)
+				postFull.Author = &author
+				continue
 			}
-			postFull["author"] = author
+			batch.Queue(stmt(selectUserByNicknameStmt), post.Author)
+			scans = append(scans, func(row pgx.Row) error {
+				author, err := scanUser(row)
+				if err != nil {
+					return err
+				}
+				if cacheable {
+					userCache.set(userCacheKey(author.Nickname), author)
+				}
+				postFull.Author = &author
+				return nil
+			})
 		case "thread":
-			thread, err := SelectThreadByID(post.Thread)
-			if err != nil {
-				return postFull, err
+			if cached, ok := threadCache.get(threadCacheKey(post.Thread)); ok {
+				thread := cached.(models.Thread)
+				postFull.Thread = &thread
+				continue
 			}
-			postFull["thread"] = thread
+			batch.Queue(stmt(selectThreadByIDStmt), post.Thread)
+			scans = append(scans, func(row pgx.Row) error {
+				thread, err := scanThread(row)
+				if err != nil {
+					return err
+				}
+				if cacheable {
+					threadCache.set(threadCacheKey(thread.ID), thread)
+				}
+				postFull.Thread = &thread
+				return nil
+			})
 		case "forum":
-			forum, err := SelectForum(post.Forum)
-			if err != nil {
-				return postFull, err
+			if cached, ok := forumCache.get(forumCacheKey(post.Forum)); ok {
+				forum := cached.(models.Forum)
+				postFull.Forum = &forum
+				continue
 			}
-			postFull["forum"] = forum
+			batch.Queue(stmt(selectForumStmt), post.Forum)
+			scans = append(scans, func(row pgx.Row) error {
+				forum, err := scanForum(row)
+				if err != nil {
+					return err
+				}
+				if cacheable {
+					forumCache.set(forumCacheKey(forum.Slug), forum)
+				}
+				postFull.Forum = &forum
+				return nil
+			})
+		}
+	}
+
+	if batch.Len() == 0 {
+		return postFull, nil
+	}
+
+	results := db.SendBatch(ctx, batch)
+	defer results.Close()
+
+	for _, scan := range scans {
+		err = scan(results.QueryRow())
+		if err != nil {
+			return postFull, err
 		}
 	}
 
 	return postFull, nil
 }
 
-func UpdatePost(postUpdate models.PostUpdate, id int) (models.Post, error) {
+// UpdatePost only applies when postUpdate.Version is zero or still current;
+// otherwise it returns the current post with errVersionConflict.
+func UpdatePost(ctx context.Context, postUpdate models.PostUpdate, id int) (models.Post, error) {
 	var p models.Post
-	row := models.DB.QueryRow(`UPDATE posts SET message=COALESCE(NULLIF($1, ''), message), 
-		is_edited = CASE WHEN $1 = '' OR message = $1 THEN false ELSE true END WHERE id=$2 RETURNING *;`, postUpdate.Message, id)
-	err := row.Scan(&p.Author, &p.Created, &p.Forum, &p.ID, &p.IsEdited, &p.Message, &p.Parent, &p.Thread, &p.Path)
-	return p, err
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return p, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, stmt(updatePostStmt), postUpdate.Message, id, postUpdate.Version)
+	p, err = scanPost(row)
+	if err == pgx.ErrNoRows && postUpdate.Version != 0 {
+		p, err = scanPost(tx.QueryRow(ctx, stmt(selectPostStmt), id))
+		if err == nil {
+			err = errVersionConflict
+		}
+	}
+	if err != nil {
+		return p, err
+	}
+
+	err = AppendEvent(ctx, tx, models.EventPostUpdated, strconv.Itoa(p.ID), p)
+	if err != nil {
+		return p, err
+	}
+
+	err = EnqueueWebhookEvent(ctx, tx, p.Forum, models.EventPostUpdated, p)
+	if err != nil {
+		return p, err
+	}
+
+	// The edit moved the thread's posts_edited.
+	err = invalidateCache(ctx, tx, threadCacheKey(p.Thread))
+	if err != nil {
+		return p, err
+	}
+
+	return p, tx.Commit(ctx)
+}
+
+// SelectPostsByAuthor lists the posts a user wrote, in every thread.
+func SelectPostsByAuthor(ctx context.Context, nickname, since string, limit int, desc bool, fn func(models.Post) error) error {
+	var rows pgx.Rows
+	var err error
+
+	if since != "" {
+		if desc {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserPostsBeforeStmt), nickname, since, limit)
+		} else {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserPostsAfterStmt), nickname, since, limit)
+		}
+	} else {
+		if desc {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserPostsDescStmt), nickname, limit)
+		} else {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserPostsStmt), nickname, limit)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SelectPostReplies lists the posts under post in tree order, at most depth
+// levels down unless depth is 0, after the post since unless it is 0.
+func SelectPostReplies(ctx context.Context, post models.Post, depth, since, limit int, fn func(models.Post) error) error {
+	rows, err := readDB(ctx).Query(ctx, stmt(selectPostRepliesStmt), post.Thread, post.Path, depth, since, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SelectPostContext reads a post with its ancestors and up to siblings posts
+// that share its parent on either side, all in one round trip after the post.
+func SelectPostContext(ctx context.Context, id, siblings int) (models.PostContext, error) {
+	postContext := models.PostContext{Ancestors: []models.Post{}, Before: []models.Post{}, After: []models.Post{}}
+	db := readDB(ctx)
+
+	post, err := scanPost(db.QueryRow(ctx, stmt(selectPostStmt), id))
+	if err != nil {
+		return postContext, err
+	}
+	postContext.Post = post
+
+	// The path holds the ids of every ancestor and then the post itself.
+	ancestors := make([]int64, 0, len(post.Path.Elements))
+	for _, element := range post.Path.Elements {
+		if element.Int != int64(post.ID) {
+			ancestors = append(ancestors, element.Int)
+		}
+	}
+	var ancestorArray pgtype.Int8Array
+	err = ancestorArray.Set(ancestors)
+	if err != nil {
+		return postContext, err
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue(stmt(selectPostAncestorsStmt), ancestorArray)
+	if post.Parent.Valid {
+		batch.Queue(stmt(selectPostSiblingsBeforeStmt), post.Parent.Int64, post.ID, siblings)
+		batch.Queue(stmt(selectPostSiblingsAfterStmt), post.Parent.Int64, post.ID, siblings)
+	} else {
+		batch.Queue(stmt(selectPostRootSiblingsBeforeStmt), post.Thread, post.ID, siblings)
+		batch.Queue(stmt(selectPostRootSiblingsAfterStmt), post.Thread, post.ID, siblings)
+	}
+
+	results := db.SendBatch(ctx, batch)
+	defer results.Close()
+
+	for _, posts := range []*[]models.Post{&postContext.Ancestors, &postContext.Before, &postContext.After} {
+		rows, err := results.Query()
+		if err != nil {
+			return postContext, err
+		}
+		for rows.Next() {
+			p, err := scanPost(rows)
+			if err != nil {
+				rows.Close()
+				return postContext, err
+			}
+			*posts = append(*posts, p)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return postContext, err
+		}
+	}
+
+	// Siblings before the post were read nearest first.
+	before := postContext.Before
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	return postContext, results.Close()
 }
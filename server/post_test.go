@@ -0,0 +1,92 @@
+package server
+
+import (
+	"forum_dbms/models"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func getThreadPosts(thread int, etag string) *fasthttp.RequestCtx {
+	id := strconv.Itoa(thread)
+	ctx := testRequest(fasthttp.MethodGet, "/api/thread/"+id+"/posts?limit=10", "", map[string]string{"threadnameOrID": id})
+	if etag != "" {
+		ctx.Request.Header.Set("If-None-Match", etag)
+	}
+	ThreadPosts(ctx)
+	return ctx
+}
+
+func TestThreadPostsETagFollowsPostsAndEdits(t *testing.T) {
+	ctx := testDB(t)
+	testUser(t, ctx, "author")
+	testForum(t, ctx, "etags", "author")
+	thread := testThread(t, ctx, "etags", "author", time.Now())
+
+	first := getThreadPosts(thread.ID, "")
+	etag := string(first.Response.Header.Peek("ETag"))
+	if first.Response.StatusCode() != http.StatusOK || etag == "" {
+		t.Fatalf("first read = %d with ETag %q, want 200 with an ETag", first.Response.StatusCode(), etag)
+	}
+	if status := getThreadPosts(thread.ID, etag).Response.StatusCode(); status != http.StatusNotModified {
+		t.Fatalf("unchanged thread = %d, want %d", status, http.StatusNotModified)
+	}
+
+	posts, err := InsertPosts(ctx, []models.Post{{Author: "author", Message: "first"}}, thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := getThreadPosts(thread.ID, etag)
+	if status := added.Response.StatusCode(); status != http.StatusOK {
+		t.Fatalf("after a new post = %d, want %d", status, http.StatusOK)
+	}
+	etag = string(added.Response.Header.Peek("ETag"))
+
+	_, err = UpdatePost(ctx, models.PostUpdate{Message: "edited"}, posts[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getThreadPosts(thread.ID, etag).Response.StatusCode(); status != http.StatusOK {
+		t.Fatalf("after an edit = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestPostBatchUpdatesThreadAndForumCounters(t *testing.T) {
+	ctx := testDB(t)
+	testUser(t, ctx, "author")
+	testForum(t, ctx, "counts", "author")
+	thread := testThread(t, ctx, "counts", "author", time.Now())
+
+	batch := make([]models.Post, 3)
+	for i := range batch {
+		batch[i] = models.Post{Author: "author", Message: "post " + strconv.Itoa(i)}
+	}
+	posts, err := InsertPosts(ctx, batch, thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := models.Post{Author: "author", Message: "reply"}
+	reply.Parent.Int64, reply.Parent.Valid = int64(posts[0].ID), true
+	_, err = InsertPosts(ctx, []models.Post{reply}, thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := SelectThreadByID(ctx, thread.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Posts != 4 || updated.LastPostAt == nil {
+		t.Fatalf("thread has %d posts, last at %v, want 4 posts and a last post time", updated.Posts, updated.LastPostAt)
+	}
+	forum, err := SelectForum(ctx, "counts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forum.Posts != 4 {
+		t.Fatalf("forum has %d posts, want 4", forum.Posts)
+	}
+}
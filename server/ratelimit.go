@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/fasthttp/router"
+	"github.com/valyala/fasthttp"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rateLimitCleanupEvery = time.Minute
+
+// RateLimit allows Burst requests at once, refilled at Rate per second. A zero
+// Rate turns the limit off, which is the default: deployments opt in with
+// -read-rate and -write-rate.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var (
+	ReadLimit  = RateLimit{Rate: 0, Burst: 1000}
+	WriteLimit = RateLimit{Rate: 0, Burst: 100}
+
+	// SharedRateLimit keeps counters in Postgres so that every instance
+	// behind a load balancer enforces the same budget.
+	SharedRateLimit = false
+)
+
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+type rateLimitStore interface {
+	take(ctx context.Context, keys []string, limit RateLimit) (rateDecision, error)
+}
+
+var (
+	localRateLimits  = newTokenBuckets()
+	sharedRateLimits = postgresRateLimits{}
+)
+
+// Limit applies limit to handler separately for each client IP and, for writes
+// made as an author, each author nickname. Every route has its own budget.
+func Limit(limit RateLimit, handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if limit.Rate <= 0 {
+		return handler
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		route, _ := ctx.UserValue(router.MatchedRoutePathParam).(string)
+		route = string(ctx.Method()) + " " + route
+
+		keys := []string{route + " ip:" + ctx.RemoteIP().String()}
+		if author := requestAuthor(ctx); author != "" {
+			keys = append(keys, route+" user:"+cacheKey(author))
+		}
+
+		var store rateLimitStore = localRateLimits
+		if SharedRateLimit {
+			store = sharedRateLimits
+		}
+
+		decision, err := store.take(ctx, keys, limit)
+		if err != nil {
+			// Failing open: a broken counter table must not take the API down.
+			log.Println(err)
+			handler(ctx)
+			return
+		}
+
+		header := &ctx.Response.Header
+		header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		header.Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.reset)))
+		if !decision.allowed {
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(decision.retryAfter)))
+			ctx.SetStatusCode(http.StatusTooManyRequests)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Too many requests"))
+			return
+		}
+
+		handler(ctx)
+	}
+}
+
+// requestAuthor finds who a write acts as: the {username} path parameter or
+// the author of a JSON body, including the first post of a batch. Reads only
+// name the user they look at, so they have no author: otherwise anyone could
+// spend a victim's budget by listing the victim's profile.
+func requestAuthor(ctx *fasthttp.RequestCtx) string {
+	if ctx.IsGet() || ctx.IsHead() {
+		return ""
+	}
+	if username, ok := ctx.UserValue("username").(string); ok {
+		return username
+	}
+
+	var body struct {
+		Author   string `json:"author"`
+		Nickname string `json:"nickname"`
+		User     string `json:"user"`
+	}
+
+	// Only the first post of a batch is decoded, so a large batch costs no
+	// more to rate limit than a single post.
+	raw := bytes.TrimSpace(ctx.Request.Body())
+	if len(raw) == 0 {
+		return ""
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if raw[0] == '[' {
+		if _, err := decoder.Token(); err != nil || !decoder.More() {
+			return ""
+		}
+	}
+
+	if decoder.Decode(&body) != nil {
+		return ""
+	}
+	switch {
+	case body.Author != "":
+		return body.Author
+	case body.Nickname != "":
+		return body.Nickname
+	}
+	return body.User
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// tokenBuckets is the in-process store.
+type tokenBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newTokenBuckets() *tokenBuckets {
+	return &tokenBuckets{buckets: make(map[string]*tokenBucket)}
+}
+
+// take spends one token from every key's bucket, or from none of them when
+// any is empty.
+func (t *tokenBuckets) take(ctx context.Context, keys []string, limit RateLimit) (rateDecision, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	burst := float64(limit.Burst)
+	decision := rateDecision{allowed: true, remaining: limit.Burst}
+
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, key := range keys {
+		bucket, ok := t.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: burst, updated: now}
+			t.buckets[key] = bucket
+		}
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.Rate)
+		bucket.updated = now
+		buckets = append(buckets, bucket)
+
+		if bucket.tokens < 1 {
+			decision.allowed = false
+			wait := secondsDuration((1 - bucket.tokens) / limit.Rate)
+			if wait > decision.retryAfter {
+				decision.retryAfter = wait
+			}
+		}
+	}
+
+	for _, bucket := range buckets {
+		if decision.allowed {
+			bucket.tokens--
+		}
+		if remaining := int(bucket.tokens); remaining < decision.remaining {
+			decision.remaining = remaining
+		}
+		reset := secondsDuration((burst - bucket.tokens) / limit.Rate)
+		bucket.full = now.Add(reset)
+		if reset > decision.reset {
+			decision.reset = reset
+		}
+	}
+	return decision, nil
+}
+
+// sweep drops buckets that have refilled: a new one would start out the same.
+func (t *tokenBuckets) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for key, bucket := range t.buckets {
+		if now.After(bucket.full) {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// postgresRateLimits approximates the token bucket with a fixed window long
+// enough to refill a whole burst, counted in a table every instance shares.
+type postgresRateLimits struct{}
+
+func (postgresRateLimits) take(ctx context.Context, keys []string, limit RateLimit) (rateDecision, error) {
+	window := time.Duration(math.Max(1, math.Ceil(float64(limit.Burst)/limit.Rate))) * time.Second
+	decision := rateDecision{allowed: true, remaining: limit.Burst}
+
+	counts, reset, err := IncrementRateLimits(ctx, keys, window)
+	if err != nil {
+		return decision, err
+	}
+
+	decision.reset = reset
+	for _, count := range counts {
+		if count > limit.Burst {
+			decision.allowed = false
+			decision.retryAfter = reset
+		}
+		if remaining := limit.Burst - count; remaining < decision.remaining {
+			decision.remaining = remaining
+		}
+	}
+	if decision.remaining < 0 {
+		decision.remaining = 0
+	}
+	return decision, nil
+}
+
+// RunRateLimitCleanup forgets idle buckets and expired shared windows until
+// the process exits.
+func RunRateLimitCleanup() {
+	ticker := time.NewTicker(rateLimitCleanupEvery)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		localRateLimits.sweep()
+		if SharedRateLimit {
+			err := DeleteExpiredRateLimits(context.Background())
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
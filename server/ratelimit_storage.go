@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+	"time"
+)
+
+var (
+	incrementRateLimitsStmt = statement("incrementRateLimits", `INSERT INTO rate_limits(key, expires)
+		SELECT k, to_timestamp((floor(extract(epoch FROM now()) / $2::int) + 1) * $2::int) FROM unnest($1::text[]) k
+		ON CONFLICT (key, expires) DO UPDATE SET count = rate_limits.count + 1
+		RETURNING count, extract(epoch FROM expires - now());`)
+
+	deleteExpiredRateLimitsStmt = statement("deleteExpiredRateLimits", `DELETE FROM rate_limits WHERE expires < now();`)
+)
+
+// IncrementRateLimits counts one request against every key in the current
+// window and returns the new counts along with the time left in the window.
+// Windows are aligned to the epoch so all instances agree on them.
+func IncrementRateLimits(ctx context.Context, keys []string, window time.Duration) ([]int, time.Duration, error) {
+	var counts []int
+	var reset time.Duration
+
+	keyArray, err := textArray(keys)
+	if err != nil {
+		return counts, reset, err
+	}
+
+	rows, err := models.DB.Query(ctx, stmt(incrementRateLimitsStmt), keyArray, int64(window/time.Second))
+	if err != nil {
+		return counts, reset, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var count int
+		var seconds float64
+		err = rows.Scan(&count, &seconds)
+		if err != nil {
+			return counts, reset, err
+		}
+		counts = append(counts, count)
+		reset = secondsDuration(seconds)
+	}
+	return counts, reset, rows.Err()
+}
+
+func DeleteExpiredRateLimits(ctx context.Context) error {
+	_, err := models.DB.Exec(ctx, stmt(deleteExpiredRateLimitsStmt))
+	return err
+}
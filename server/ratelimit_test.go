@@ -0,0 +1,51 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRequestAuthor(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{``, ""},
+		{`{"author":"alice","message":"hi"}`, "alice"},
+		{`{"nickname":"bob","voice":1}`, "bob"},
+		{`{"slug":"f","user":"carol"}`, "carol"},
+		{`[{"author":"dave","message":"1"},{"author":"erin","message":"2"}]`, "dave"},
+		{`[]`, ""},
+		{`not json`, ""},
+		// Only the first post is read, so the rest of a batch is never parsed.
+		{`[{"author":"frank"},` + strings.Repeat("x", 1<<20), "frank"},
+	}
+	for _, tt := range tests {
+		ctx := testRequest(fasthttp.MethodPost, "/", tt.body, nil)
+		if got := requestAuthor(ctx); got != tt.want {
+			t.Errorf("requestAuthor(%.40q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRequestAuthorPrefersThePath(t *testing.T) {
+	ctx := testRequest(fasthttp.MethodPost, "/", `{"author":"alice"}`, map[string]string{"username": "bob"})
+	if got := requestAuthor(ctx); got != "bob" {
+		t.Fatalf("requestAuthor = %q, want the path's %q", got, "bob")
+	}
+}
+
+func TestReadsHaveNoAuthor(t *testing.T) {
+	ctx := testRequest(fasthttp.MethodGet, "/", "", map[string]string{"username": "bob"})
+	if got := requestAuthor(ctx); got != "" {
+		t.Fatalf("requestAuthor of a read = %q, want none", got)
+	}
+}
+
+func TestLimitIsOffByDefault(t *testing.T) {
+	if ReadLimit.Rate != 0 || WriteLimit.Rate != 0 {
+		t.Fatalf("default rates = %v and %v, want both off", ReadLimit.Rate, WriteLimit.Rate)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/valyala/fasthttp"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicaCheckEvery   = time.Second
+	replicaCheckTimeout = time.Second
+	readPoolKey         = "readPool"
+)
+
+// MaxReplicaLag is how far a replica may fall behind the primary before reads
+// stop going to it.
+var MaxReplicaLag = 5 * time.Second
+
+type replica struct {
+	pool    *pgxpool.Pool
+	healthy int32
+}
+
+var (
+	replicas    []*replica
+	replicaNext uint32
+)
+
+// UseReplicas sends read-only listings to pools from now on. It must be called
+// before the server starts, and is followed by RunReplicaMonitor.
+func UseReplicas(pools []*pgxpool.Pool) {
+	for _, pool := range pools {
+		replicas = append(replicas, &replica{pool: pool})
+	}
+	checkReplicas()
+}
+
+// readDB picks the pool for a read-only query: the next healthy replica in
+// turn, or the primary when there is none. Reads made while serving one request
+// stay on the pool picked first, so that a listing and its ETag agree.
+func readDB(ctx context.Context) *pgxpool.Pool {
+	if pool, ok := ctx.Value(readPoolKey).(*pgxpool.Pool); ok {
+		return pool
+	}
+
+	pool := models.DB
+	for range replicas {
+		r := replicas[atomic.AddUint32(&replicaNext, 1)%uint32(len(replicas))]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			pool = r.pool
+			break
+		}
+	}
+
+	if requestCtx, ok := ctx.(*fasthttp.RequestCtx); ok {
+		requestCtx.SetUserValue(readPoolKey, pool)
+	}
+	return pool
+}
+
+// RunReplicaMonitor keeps checking replica lag until the process exits.
+func RunReplicaMonitor() {
+	if len(replicas) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(replicaCheckEvery)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		checkReplicas()
+	}
+}
+
+func checkReplicas() {
+	for _, r := range replicas {
+		healthy := int32(0)
+		lag, err := replicaLag(r.pool)
+		switch {
+		case err != nil:
+			log.Println(err)
+		case lag <= MaxReplicaLag:
+			healthy = 1
+		}
+
+		if atomic.SwapInt32(&r.healthy, healthy) != healthy {
+			log.Printf("replica %s healthy: %t (lag %s)", r.pool.Config().ConnConfig.Host, healthy == 1, lag)
+		}
+	}
+}
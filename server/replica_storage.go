@@ -0,0 +1,22 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// replicaLagStmt reports zero while a replica has replayed everything it
+// received, and otherwise the age of the last transaction it replayed.
+var replicaLagStmt = statement("replicaLag", `SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(extract(epoch FROM now() - pg_last_xact_replay_timestamp()), 0) END::float8;`)
+
+func replicaLag(pool *pgxpool.Pool) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+	defer cancel()
+
+	var seconds float64
+	err := pool.QueryRow(ctx, stmt(replicaLagStmt)).Scan(&seconds)
+	return secondsDuration(seconds), err
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"github.com/mailru/easyjson"
+	"github.com/mailru/easyjson/jwriter"
+	"github.com/valyala/fasthttp"
+	"log"
+)
+
+// writeJSON answers with the generated marshaler of v. The JSON is built in
+// easyjson's pooled buffers and copied straight into the response body.
+func writeJSON(ctx *fasthttp.RequestCtx, status int, v easyjson.Marshaler) {
+	var w jwriter.Writer
+	v.MarshalEasyJSON(&w)
+	if w.Error != nil {
+		log.Println(w.Error)
+		return
+	}
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.ResetBody()
+	_, err := w.DumpTo(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+}
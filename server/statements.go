@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// statements is the registry of every fixed query the storage layer runs,
+// keyed by name. The storage files register their SQL with statement, and
+// PrepareStatements prepares all of it on each new pool connection, so
+// Postgres parses and plans a query once per connection instead of per call.
+var statements = map[string]string{}
+
+// PreparedStatements can be switched off to compare latency against the
+// simple protocol; storage calls then send the SQL text itself.
+var PreparedStatements = true
+
+// statement registers sql under name and returns the name.
+func statement(name, sql string) string {
+	if _, ok := statements[name]; ok {
+		panic(fmt.Sprintf("statement %s registered twice", name))
+	}
+	statements[name] = sql
+	return name
+}
+
+// statementSeries registers a list of statements run one after another,
+// naming them prefix1, prefix2 and so on.
+func statementSeries(prefix string, sqls ...string) []string {
+	names := make([]string, len(sqls))
+	for i, sql := range sqls {
+		names[i] = statement(fmt.Sprintf("%s%d", prefix, i+1), sql)
+	}
+	return names
+}
+
+// stmt is what storage passes to pgx for a registered statement.
+func stmt(name string) string {
+	if PreparedStatements {
+		return name
+	}
+	return statements[name]
+}
+
+// PrepareStatements is the pool's AfterConnect hook.
+func PrepareStatements(ctx context.Context, conn *pgx.Conn) error {
+	for name, sql := range statements {
+		_, err := conn.Prepare(ctx, name, sql)
+		if err != nil {
+			return fmt.Errorf("prepare %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// textArray passes a []string in a form both the extended and the simple
+// protocol can send.
+func textArray(values []string) (pgtype.TextArray, error) {
+	var array pgtype.TextArray
+	err := array.Set(values)
+	if err != nil {
+		return array, fmt.Errorf("text array: %v", err)
+	}
+	return array, nil
+}
+
+// intArray is textArray for a []int. It fails on values that don't fit in
+// an int4.
+func intArray(values []int) (pgtype.Int4Array, error) {
+	var array pgtype.Int4Array
+	err := array.Set(values)
+	if err != nil {
+		return array, fmt.Errorf("int array: %v", err)
+	}
+	return array, nil
+}
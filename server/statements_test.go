@@ -0,0 +1,77 @@
+package server
+
+import (
+	"forum_dbms/models"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+func TestArraysReportValuesTheyCantHold(t *testing.T) {
+	if _, err := intArray([]int{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := intArray([]int{math.MaxInt32 + 1}); err == nil {
+		t.Fatal("intArray accepted a value that does not fit in an int4")
+	}
+	if _, err := textArray([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkStatements compares the latency of a thread page read with the
+// statements prepared on connect against the same read sent as plain text,
+// as the -prepare flag switches.
+func BenchmarkStatements(b *testing.B) {
+	ctx := testDB(b)
+	testUser(b, ctx, "author")
+	testForum(b, ctx, "bench", "author")
+	thread := testThread(b, ctx, "bench", "author", time.Now())
+	posts := make([]models.Post, 100)
+	for i := range posts {
+		posts[i] = models.Post{Author: "author", Message: "message"}
+	}
+	if _, err := InsertPosts(ctx, posts, thread); err != nil {
+		b.Fatal(err)
+	}
+
+	config, err := pgxpool.ParseConfig(os.Getenv("FORUM_TEST_DB"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	config.AfterConnect = PrepareStatements
+	prepared, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer prepared.Close()
+
+	unprepared := models.DB
+	defer func() {
+		models.DB = unprepared
+		PreparedStatements = true
+	}()
+
+	for _, bench := range []struct {
+		name     string
+		pool     *pgxpool.Pool
+		prepared bool
+	}{
+		{"unprepared", unprepared, false},
+		{"prepared", prepared, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			models.DB, PreparedStatements = bench.pool, bench.prepared
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := SelectPosts(ctx, thread.ID, 20, 0, "tree", false, func(models.Post) error { return nil })
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"forum_dbms/models"
+)
+
+// errVersionConflict is returned by the edits when the caller's expected
+// version is stale; the entity returned alongside it is the current one.
+var errVersionConflict = errors.New("version conflict")
+
+// Column lists shared by every query that reads a whole entity. They match
+// the scan functions below, which is why nothing selects * any more.
+const (
+	userColumns   = `about, email, fullname, nickname, version, updated`
+	forumColumns  = `username, posts, threads, slug, title, last_activity, version, updated`
+	threadColumns = `author, created, forum, id, message, slug, title, votes, posts, last_post_at, posts_edited, version, updated`
+	postColumns   = `author, created, forum, id, is_edited, message, parent, thread, path, version, updated`
+)
+
+// rowScanner is satisfied by both pgx.Row and pgx.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (models.User, error) {
+	var u models.User
+	err := row.Scan(&u.About, &u.Email, &u.Fullname, &u.Nickname, &u.Version, &u.Updated)
+	return u, err
+}
+
+func scanForum(row rowScanner) (models.Forum, error) {
+	var f models.Forum
+	err := row.Scan(&f.User, &f.Posts, &f.Threads, &f.Slug, &f.Title, &f.LastActivity, &f.Version, &f.Updated)
+	return f, err
+}
+
+func scanThread(row rowScanner) (models.Thread, error) {
+	var th models.Thread
+	err := row.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes,
+		&th.Posts, &th.LastPostAt, &th.PostsEdited, &th.Version, &th.Updated)
+	return th, err
+}
+
+func scanPost(row rowScanner) (models.Post, error) {
+	var p models.Post
+	err := row.Scan(&p.Author, &p.Created, &p.Forum, &p.ID, &p.IsEdited, &p.Message, &p.Parent, &p.Thread, &p.Path,
+		&p.Version, &p.Updated)
+	return p, err
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+)
+
+// listLimit applies MaxListLimit, which also stands in for "no limit".
+func listLimit(limit int) int {
+	if limit <= 0 || limit > MaxListLimit {
+		return MaxListLimit
+	}
+	return limit
+}
+
+// errStreamClosed stops a fill whose response can no longer be written.
+var errStreamClosed = errors.New("response stream closed")
+
+// streamJSONArray answers with a JSON array whose elements fill emits, so a
+// listing never has to fit in memory. fill runs right away and the status is
+// only chosen once its first element arrives: a query that fails before then
+// answers 500. An error half way through can only cut the array short.
+func streamJSONArray(ctx *fasthttp.RequestCtx, fill func(emit func(easyjson.Marshaler) error) error) {
+	rows := make(chan easyjson.Marshaler)
+	stop := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		defer close(rows)
+		result <- fill(func(v easyjson.Marshaler) error {
+			select {
+			case rows <- v:
+				return nil
+			case <-stop:
+				return errStreamClosed
+			}
+		})
+	}()
+
+	first, ok := <-rows
+	if !ok {
+		if err := <-result; err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Can't read the list"))
+			return
+		}
+		ctx.SetStatusCode(http.StatusOK)
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString("[]")
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		array := jsonArrayWriter{w: w}
+		err := array.write(first)
+		for v := range rows {
+			if err == nil {
+				err = array.write(v)
+			}
+			if err != nil {
+				close(stop)
+				break
+			}
+		}
+
+		if fillErr := <-result; fillErr != nil && fillErr != errStreamClosed {
+			err = fillErr
+		}
+		if err == nil {
+			err = array.close()
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+type jsonArrayWriter struct {
+	w     *bufio.Writer
+	count int
+}
+
+func (a *jsonArrayWriter) write(v easyjson.Marshaler) error {
+	separator := byte(',')
+	if a.count == 0 {
+		separator = '['
+	}
+	a.count++
+
+	err := a.w.WriteByte(separator)
+	if err != nil {
+		return err
+	}
+	_, err = easyjson.MarshalToWriter(v, a.w)
+	return err
+}
+
+func (a *jsonArrayWriter) close() error {
+	if a.count == 0 {
+		_, err := a.w.WriteString("[]")
+		return err
+	}
+	return a.w.WriteByte(']')
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"forum_dbms/models"
+	"net/http"
+	"testing"
+
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+)
+
+func streamTest(fill func(emit func(easyjson.Marshaler) error) error) *fasthttp.RequestCtx {
+	ctx := testRequest(fasthttp.MethodGet, "/", "", nil)
+	streamJSONArray(ctx, fill)
+	return ctx
+}
+
+func TestStreamJSONArrayAnswers500WhenTheQueryFails(t *testing.T) {
+	ctx := streamTest(func(emit func(easyjson.Marshaler) error) error {
+		return errors.New("connection refused")
+	})
+	if status := ctx.Response.StatusCode(); status != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+}
+
+func TestStreamJSONArray(t *testing.T) {
+	empty := streamTest(func(emit func(easyjson.Marshaler) error) error {
+		return nil
+	})
+	if status, body := empty.Response.StatusCode(), string(empty.Response.Body()); status != http.StatusOK || body != "[]" {
+		t.Fatalf("empty list = %d %s, want 200 []", status, body)
+	}
+
+	full := streamTest(func(emit func(easyjson.Marshaler) error) error {
+		for _, message := range []string{"a", "b"} {
+			if err := emit(models.Error{Message: message}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	want := `[{"message":"a"},{"message":"b"}]`
+	if status, body := full.Response.StatusCode(), string(full.Response.Body()); status != http.StatusOK || body != want {
+		t.Fatalf("list = %d %s, want 200 %s", status, body, want)
+	}
+}
@@ -1,14 +1,14 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"forum_dbms/models"
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgconn"
+	"github.com/mailru/easyjson"
 	"github.com/valyala/fasthttp"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func CreateThread(ctx *fasthttp.RequestCtx) {
@@ -24,31 +24,23 @@ func CreateThread(ctx *fasthttp.RequestCtx) {
 	}
 
 	var thread models.Thread
-	err := json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&thread)
+	err := easyjson.Unmarshal(ctx.Request.Body(), &thread)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	thread.Forum = slug
-	threadInsert, err := InsertThread(thread)
+	threadInsert, err := InsertThread(ctx, thread)
 	if err != nil {
-		if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" {
-			thread, err := SelectThread(thread.Slug.String)
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
+			thread, err := SelectThread(ctx, thread.Slug.String)
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			body, err := json.Marshal(thread)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			ctx.SetStatusCode(http.StatusConflict)
-			ctx.SetContentType("application/json")
-			ctx.SetBody(body)
+			writeJSON(ctx, http.StatusConflict, thread)
 			return
 		}
 		ctx.SetStatusCode(http.StatusNotFound)
@@ -57,15 +49,7 @@ func CreateThread(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(threadInsert)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	ctx.SetStatusCode(http.StatusCreated)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusCreated, threadInsert)
 }
 
 func ForumThreads(ctx *fasthttp.RequestCtx) {
@@ -107,29 +91,24 @@ func ForumThreads(ctx *fasthttp.RequestCtx) {
 	sinceParam := string(queryParams.Peek("since"))
 	since := sinceParam
 
-	threads, err := SelectThreads(forum, since, limit, desc)
-	if len(threads) == 0 {
-		if !CheckThread(forum) {
-			ctx.SetStatusCode(http.StatusNotFound)
-			ctx.SetContentType("application/json")
-			ctx.SetBody(jsonToMessage("Can't find forum"))
-			return
-		}
+	if _, err := SelectForum(ctx, forum); err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
-		ctx.SetBody([]byte("[]"))
+		ctx.SetBody(jsonToMessage("Can't find forum"))
 		return
 	}
 
-	body, err := json.Marshal(threads)
-	if err != nil {
-		log.Println(err)
+	limit = listLimit(limit)
+	if sort := string(queryParams.Peek("sort")); sort != "" {
+		forumThreadsSorted(ctx, forum, sort, since, limit, desc)
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
-
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectThreads(ctx, forum, since, limit, desc, func(th models.Thread) error {
+			return emit(th)
+		})
+	})
 }
 
 func VoteThread(ctx *fasthttp.RequestCtx) {
@@ -144,7 +123,7 @@ func VoteThread(ctx *fasthttp.RequestCtx) {
 	}
 
 	var vote models.Vote
-	err := json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&vote)
+	err := easyjson.Unmarshal(ctx.Request.Body(), &vote)
 	if err != nil {
 		log.Println(err)
 		return
@@ -155,7 +134,7 @@ func VoteThread(ctx *fasthttp.RequestCtx) {
 	case nil:
 		vote.Thread = slugID
 	default:
-		vote.Thread, err = SelectThreadID(slug)
+		vote.Thread, err = SelectThreadID(ctx, slug)
 	}
 
 	if err != nil {
@@ -165,10 +144,10 @@ func VoteThread(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	err = InsertVote(vote)
+	err = InsertVote(ctx, vote)
 	if err != nil {
-		if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" {
-			err = UpdateVote(vote)
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
+			err = UpdateVote(ctx, vote)
 			if err != nil {
 				ctx.SetStatusCode(http.StatusNotFound)
 				ctx.SetContentType("application/json")
@@ -183,21 +162,13 @@ func VoteThread(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
-	threadUpdate, err := SelectThreadByID(vote.Thread)
+	threadUpdate, err := SelectThreadByID(ctx, vote.Thread)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	body, err := json.Marshal(threadUpdate)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, threadUpdate)
 }
 
 func GetThreadDetails(ctx *fasthttp.RequestCtx) {
@@ -215,9 +186,9 @@ func GetThreadDetails(ctx *fasthttp.RequestCtx) {
 	var thread models.Thread
 	switch err {
 	case nil:
-		thread, err = SelectThreadByID(slugID)
+		thread, err = SelectThreadByID(ctx, slugID)
 	default:
-		thread, err = SelectThread(slug)
+		thread, err = SelectThread(ctx, slug)
 	}
 
 	if err != nil {
@@ -227,15 +198,11 @@ func GetThreadDetails(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(thread)
-	if err != nil {
-		log.Println(err)
+	if notModified(ctx, threadTag(thread), thread.Updated) {
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, thread)
 }
 
 func EditThread(ctx *fasthttp.RequestCtx) {
@@ -250,7 +217,7 @@ func EditThread(ctx *fasthttp.RequestCtx) {
 	}
 
 	var threadUpdate models.Thread
-	err := json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&threadUpdate)
+	err := easyjson.Unmarshal(ctx.Request.Body(), &threadUpdate)
 	if err != nil {
 		log.Println(err)
 		return
@@ -264,7 +231,33 @@ func EditThread(ctx *fasthttp.RequestCtx) {
 		threadUpdate.Slug.String = slug
 	}
 
-	thread, err := UpdateThread(threadUpdate)
+	// A thread's tag also covers its votes and posts, so the whole tag can
+	// only be checked against the thread as it is now.
+	if len(ctx.Request.Header.Peek("If-Match")) != 0 {
+		var current models.Thread
+		if threadUpdate.ID > 0 {
+			current, err = SelectThreadByID(ctx, threadUpdate.ID)
+		} else {
+			current, err = SelectThread(ctx, slug)
+		}
+		if err != nil {
+			ctx.SetStatusCode(http.StatusNotFound)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Can't find thread by id"))
+			return
+		}
+		threadUpdate.Version = expectedVersion(ctx, threadUpdate.Version, func(version int64) string {
+			if version != current.Version {
+				return ""
+			}
+			return threadTag(current)
+		})
+	}
+	thread, err := UpdateThread(ctx, threadUpdate)
+	if err == errVersionConflict {
+		preconditionFailed(ctx, thread, threadTag(thread))
+		return
+	}
 	if err != nil {
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
@@ -272,13 +265,101 @@ func EditThread(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(thread)
+	ctx.Response.Header.Set("ETag", threadTag(thread))
+	writeJSON(ctx, http.StatusOK, thread)
+}
+
+// threadSortValue is the value of the sort column of thread, as its cursor
+// carries it.
+func threadSortValue(sort string, thread models.Thread) interface{} {
+	switch sort {
+	case "votes":
+		return thread.Votes
+	case "activity":
+		return thread.LastPostAt
+	case "replies":
+		return thread.Posts
+	default:
+		return thread.Created
+	}
+}
+
+// parseThreadSortValue reads since, or the value in a cursor, as the type of
+// the sort column. A cursor that is missing leaves the zero value.
+func parseThreadSortValue(sort, since, cursor string) (interface{}, interface{}, int, error) {
+	var sinceValue interface{}
+	var afterKey string
+	var err error
+	switch sort {
+	case "votes", "replies":
+		var after int64
+		afterKey, err = decodeCursor(cursor, sort, &after)
+		if err == nil && since != "" {
+			sinceValue, err = strconv.ParseInt(since, 10, 64)
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		afterID, err := threadCursorID(afterKey)
+		return sinceValue, after, afterID, err
+	default:
+		var after time.Time
+		afterKey, err = decodeCursor(cursor, sort, &after)
+		if err == nil && since != "" {
+			sinceValue, err = time.Parse(time.RFC3339Nano, since)
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		afterID, err := threadCursorID(afterKey)
+		return sinceValue, after, afterID, err
+	}
+}
+
+func threadCursorID(key string) (int, error) {
+	if key == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(key)
+}
+
+// forumThreadsSorted answers ForumThreads for an explicit sort. since is a
+// bound on the sort column, and pages link up through X-Next-Cursor.
+func forumThreadsSorted(ctx *fasthttp.RequestCtx, forum, sort, since string, limit int, desc bool) {
+	if _, ok := threadSorts[sort]; !ok {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Unknown sort " + sort))
+		return
+	}
+
+	sinceValue, afterValue, afterID, err := parseThreadSortValue(sort, since, string(ctx.QueryArgs().Peek("cursor")))
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Invalid since or cursor"))
+		return
+	}
+
+	// One thread past the page tells whether there is a next one.
+	threads, err := SelectThreadsSorted(ctx, forum, sort, sinceValue, afterValue, afterID, limit+1, desc)
 	if err != nil {
 		log.Println(err)
+		ctx.SetStatusCode(http.StatusInternalServerError)
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	if len(threads) > limit {
+		threads = threads[:limit]
+		last := threads[limit-1]
+		next, err := encodeCursor(sort, threadSortValue(sort, last), strconv.Itoa(last.ID))
+		if err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		ctx.Response.Header.Set("X-Next-Cursor", next)
+	}
+
+	writeJSON(ctx, http.StatusOK, models.Threads(threads))
 }
@@ -1,117 +1,421 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"forum_dbms/models"
+	"strconv"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v4"
 )
 
-func InsertThread(thread models.Thread) (models.Thread, error) {
-	var row *pgx.Row
+var (
+	insertThreadStmt = statement("insertThread", `INSERT INTO threads(author, forum, message, slug, title) VALUES ($1, $2, $3, $4, $5) RETURNING `+threadColumns+`;`)
+
+	insertThreadCreatedStmt = statement("insertThreadCreated", `INSERT INTO threads(author, created, forum, message, slug, title) VALUES ($1, $2, $3, $4, $5, $6) RETURNING `+threadColumns+`;`)
+
+	selectThreadIDStmt = statement("selectThreadID", `SELECT id FROM threads WHERE LOWER(slug)=LOWER($1) LIMIT 1;`)
+
+	selectThreadBySlugStmt = statement("selectThreadBySlug", `SELECT `+threadColumns+` FROM threads WHERE LOWER(slug)=LOWER($1) LIMIT 1;`)
+
+	selectThreadByIDStmt = statement("selectThreadByID", `SELECT `+threadColumns+` FROM threads WHERE id = $1 LIMIT 1;`)
+
+	selectForumThreadsBeforeStmt = statement("selectForumThreadsBefore", `SELECT `+threadColumns+` FROM threads WHERE LOWER(forum)=LOWER($1) AND created <= $2
+		ORDER BY created DESC LIMIT NULLIF($3, 0);`)
+
+	selectForumThreadsAfterStmt = statement("selectForumThreadsAfter", `SELECT `+threadColumns+` FROM threads WHERE LOWER(forum)=LOWER($1) AND created >= $2
+		ORDER BY created ASC LIMIT NULLIF($3, 0);`)
+
+	selectForumThreadsDescStmt = statement("selectForumThreadsDesc", `SELECT `+threadColumns+` FROM threads WHERE LOWER(forum)=LOWER($1) ORDER BY created DESC LIMIT NULLIF($2, 0);`)
+
+	selectForumThreadsStmt = statement("selectForumThreads", `SELECT `+threadColumns+` FROM threads WHERE LOWER(forum)=LOWER($1) ORDER BY created ASC LIMIT NULLIF($2, 0);`)
+
+	updateThreadByIDStmt = statement("updateThreadByID", `UPDATE threads SET message=COALESCE(NULLIF($1, ''), message),
+		title=COALESCE(NULLIF($2, ''), title) WHERE id = $3 AND ($4 = 0 OR version = $4) RETURNING `+threadColumns+`;`)
+
+	updateThreadBySlugStmt = statement("updateThreadBySlug", `UPDATE threads SET message=COALESCE(NULLIF($1, ''), message),
+		title=COALESCE(NULLIF($2, ''), title) WHERE LOWER(slug) = LOWER($3) AND ($4 = 0 OR version = $4) RETURNING `+threadColumns+`;`)
+
+	selectThreadStmt = statement("selectThread", `SELECT `+threadColumns+` FROM threads WHERE id = $1 OR ($1 = 0 AND LOWER(slug) = LOWER($2));`)
+
+	insertVoteStmt = statement("insertVote", `INSERT INTO votes(nickname, voice, thread) VALUES ($1, $2, NULLIF($3, 0));`)
+
+	updateVoteStmt = statement("updateVote", `UPDATE votes SET voice=$1 WHERE LOWER(nickname)=LOWER($2) AND thread=$3;`)
+
+	selectUserThreadsBeforeStmt = statement("selectUserThreadsBefore", `SELECT `+threadColumns+` FROM threads WHERE LOWER(author)=LOWER($1) AND created <= $2
+		ORDER BY created DESC, id DESC LIMIT NULLIF($3, 0);`)
+
+	selectUserThreadsAfterStmt = statement("selectUserThreadsAfter", `SELECT `+threadColumns+` FROM threads WHERE LOWER(author)=LOWER($1) AND created >= $2
+		ORDER BY created, id LIMIT NULLIF($3, 0);`)
+
+	selectUserThreadsDescStmt = statement("selectUserThreadsDesc", `SELECT `+threadColumns+` FROM threads WHERE LOWER(author)=LOWER($1)
+		ORDER BY created DESC, id DESC LIMIT NULLIF($2, 0);`)
+
+	selectUserThreadsStmt = statement("selectUserThreads", `SELECT `+threadColumns+` FROM threads WHERE LOWER(author)=LOWER($1)
+		ORDER BY created, id LIMIT NULLIF($2, 0);`)
+)
+
+// threadSorts maps every sort of a forum's threads to the column it orders
+// by; id breaks ties.
+var threadSorts = map[string]string{
+	"created":  "created",
+	"votes":    "votes",
+	"activity": "last_post_at",
+	"replies":  "posts",
+}
+
+// threadSortStmts holds, for every sort, the ascending and the descending
+// listing and then the same two starting at the since value in $5. ($3, $2)
+// is the position to continue after, skipped when $2 is 0.
+var threadSortStmts = func() map[string][4]string {
+	stmts := make(map[string][4]string, len(threadSorts))
+	for sort, column := range threadSorts {
+		var names [4]string
+		for i, variant := range []struct{ name, cmp, order, since string }{
+			{"", ">", "", ""},
+			{"Desc", "<", " DESC", ""},
+			{"Since", ">", "", "AND %[1]s >= $5"},
+			{"SinceDesc", "<", " DESC", "AND %[1]s <= $5"},
+		} {
+			names[i] = statement("selectForumThreadsBy"+variant.name+"_"+sort, fmt.Sprintf(`SELECT `+threadColumns+` FROM threads
+				WHERE LOWER(forum)=LOWER($1) AND ($2 = 0 OR (%[1]s, id) %[2]s ($3, $2)) `+variant.since+`
+				ORDER BY %[1]s%[3]s, id%[3]s LIMIT NULLIF($4, 0);`, column, variant.cmp, variant.order))
+		}
+		stmts[sort] = names
+	}
+	return stmts
+}()
+
+func InsertThread(ctx context.Context, thread models.Thread) (models.Thread, error) {
+	var row pgx.Row
 	timeCreated := time.Now()
 	var th models.Thread
-	forum, err := SelectForum(thread.Forum)
+	forum, err := SelectForum(ctx, thread.Forum)
 	if err != nil {
 		return th, err
 	}
+
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return th, err
+	}
+	defer tx.Rollback(ctx)
+
 	if thread.Created == timeCreated {
-		row = models.DB.QueryRow(`INSERT INTO threads(author, forum, message, slug, title) VALUES ($1, $2, $3, $4, $5) RETURNING *;`,
-			thread.Author, forum.Slug, thread.Message, thread.Slug, thread.Title)
+		row = tx.QueryRow(ctx, stmt(insertThreadStmt), thread.Author, forum.Slug, thread.Message, thread.Slug, thread.Title)
 	} else {
-		row = models.DB.QueryRow(`INSERT INTO threads(author, created, forum, message, slug, title) VALUES ($1, $2, $3, $4, $5, $6) RETURNING *;`,
+		row = tx.QueryRow(ctx, stmt(insertThreadCreatedStmt),
 			thread.Author, thread.Created, forum.Slug, thread.Message, thread.Slug, thread.Title)
 	}
 
-	err = row.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes)
-	return th, err
-}
+	th, err = scanThread(row)
+	if err != nil {
+		return th, err
+	}
+
+	err = AppendEvent(ctx, tx, models.EventThreadCreated, strconv.Itoa(th.ID), th)
+	if err != nil {
+		return th, err
+	}
+
+	err = EnqueueWebhookEvent(ctx, tx, th.Forum, models.EventThreadCreated, th)
+	if err != nil {
+		return th, err
+	}
 
-func CheckThread(slug string) bool {
-	var exists bool
-	models.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM threads WHERE LOWER(forum)=LOWER($1))`, slug).Scan(&exists)
-	return exists
+	err = invalidateCache(ctx, tx, forumCacheKey(th.Forum))
+	if err != nil {
+		return th, err
+	}
+
+	err = storeIdempotentResult(ctx, tx, th)
+	if err != nil {
+		return th, err
+	}
+
+	return th, tx.Commit(ctx)
 }
 
-func SelectThreadID(slug string) (int, error) {
+// A thread slug never changes its id, so threadIDCache is only purged, never invalidated.
+func SelectThreadID(ctx context.Context, slug string) (int, error) {
+	if cached, ok := threadIDCache.get(cacheKey(slug)); ok {
+		return cached.(int), nil
+	}
+
 	var id int
-	row := models.DB.QueryRow(`SELECT id FROM threads WHERE LOWER(slug)=LOWER($1) LIMIT 1;`, slug)
+	row := models.DB.QueryRow(ctx, stmt(selectThreadIDStmt), slug)
 	err := row.Scan(&id)
+	if err == nil {
+		threadIDCache.set(cacheKey(slug), id)
+	}
 	return id, err
 }
 
-func SelectThread(slug string) (models.Thread, error) {
-	row := models.DB.QueryRow(`SELECT * FROM threads WHERE LOWER(slug)=LOWER($1) LIMIT 1;`, slug)
-	var th models.Thread
-	err := row.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes)
+func SelectThread(ctx context.Context, slug string) (models.Thread, error) {
+	if cached, ok := threadIDCache.get(cacheKey(slug)); ok {
+		return SelectThreadByID(ctx, cached.(int))
+	}
+
+	row := models.DB.QueryRow(ctx, stmt(selectThreadBySlugStmt), slug)
+	th, err := scanThread(row)
+	if err == nil {
+		threadIDCache.set(cacheKey(slug), th.ID)
+		threadCache.set(threadCacheKey(th.ID), th)
+	}
 	return th, err
 }
 
-func SelectThreadByID(id int) (models.Thread, error) {
-	row := models.DB.QueryRow(`SELECT * FROM threads WHERE id = $1 LIMIT 1;`, id)
-	var th models.Thread
-	err := row.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes)
+func SelectThreadByID(ctx context.Context, id int) (models.Thread, error) {
+	if cached, ok := threadCache.get(threadCacheKey(id)); ok {
+		return cached.(models.Thread), nil
+	}
+
+	row := models.DB.QueryRow(ctx, stmt(selectThreadByIDStmt), id)
+	th, err := scanThread(row)
+	if err == nil {
+		threadCache.set(threadCacheKey(th.ID), th)
+	}
 	return th, err
 }
 
-func SelectThreads(forum, since string, limit int, desc bool) ([]models.Thread, error) {
-	var threads []models.Thread
-	var rows *pgx.Rows
+// SelectListedThread reads a thread, by id or by slug when id is 0, from the
+// pool its posts are listed from. It bypasses the cache, which is filled from
+// the primary, so that a listing's ETag describes the rows the listing sends.
+func SelectListedThread(ctx context.Context, id int, slug string) (models.Thread, error) {
+	return scanThread(readDB(ctx).QueryRow(ctx, stmt(selectThreadStmt), id, slug))
+}
+
+func SelectThreads(ctx context.Context, forum, since string, limit int, desc bool, fn func(models.Thread) error) error {
+	var rows pgx.Rows
 	var err error
 
 	if since != "" {
 		if desc {
-			rows, err = models.DB.Query(`SELECT * FROM threads WHERE LOWER(forum)=LOWER($1) AND created <= $2
-			ORDER BY created DESC LIMIT NULLIF($3, 0);`, forum, since, limit)
+			rows, err = readDB(ctx).Query(ctx, stmt(selectForumThreadsBeforeStmt), forum, since, limit)
 		} else {
-			rows, err = models.DB.Query(`SELECT * FROM threads WHERE LOWER(forum)=LOWER($1) AND created >= $2
-			ORDER BY created ASC LIMIT NULLIF($3, 0);`, forum, since, limit)
+			rows, err = readDB(ctx).Query(ctx, stmt(selectForumThreadsAfterStmt), forum, since, limit)
 		}
 	} else {
 		if desc {
-			rows, err = models.DB.Query(`SELECT * FROM threads WHERE LOWER(forum)=LOWER($1) ORDER BY created DESC LIMIT NULLIF($2, 0);`, forum, limit)
+			rows, err = readDB(ctx).Query(ctx, stmt(selectForumThreadsDescStmt), forum, limit)
 		} else {
-			rows, err = models.DB.Query(`SELECT * FROM threads WHERE LOWER(forum)=LOWER($1) ORDER BY created ASC LIMIT NULLIF($2, 0);`, forum, limit)
+			rows, err = readDB(ctx).Query(ctx, stmt(selectForumThreadsStmt), forum, limit)
 		}
 	}
 
 	if err != nil {
-		return threads, err
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var th models.Thread
-		err = rows.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes)
+		th, err := scanThread(rows)
 		if err != nil {
-			return threads, err
+			return err
+		}
+		if err = fn(th); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SelectThreadsSorted lists the threads of a forum in the given sort, from
+// since on when it is not nil. A page continues after the thread afterID,
+// whose sort column holds afterValue.
+func SelectThreadsSorted(ctx context.Context, forum, sort string, since, afterValue interface{}, afterID int,
+	limit int, desc bool) ([]models.Thread, error) {
+	variant := 0
+	if desc {
+		variant = 1
+	}
+
+	var rows pgx.Rows
+	var err error
+	if since != nil {
+		rows, err = readDB(ctx).Query(ctx, stmt(threadSortStmts[sort][variant+2]), forum, afterID, afterValue, limit, since)
+	} else {
+		rows, err = readDB(ctx).Query(ctx, stmt(threadSortStmts[sort][variant]), forum, afterID, afterValue, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threads := make([]models.Thread, 0, limit)
+	for rows.Next() {
+		th, err := scanThread(rows)
+		if err != nil {
+			return nil, err
 		}
 		threads = append(threads, th)
 	}
-	return threads, nil
+	return threads, rows.Err()
 }
 
-func UpdateThread(thread models.Thread) (models.Thread, error) {
-	var row *pgx.Row
-	if thread.ID > 0 {
-		row = models.DB.QueryRow(`UPDATE threads SET message=COALESCE(NULLIF($1, ''), message),
-		title=COALESCE(NULLIF($2, ''), title) WHERE id = $3 RETURNING *;`, thread.Message, thread.Title, thread.ID)
+// SelectThreadsByAuthor lists the threads a user started, in every forum.
+func SelectThreadsByAuthor(ctx context.Context, nickname, since string, limit int, desc bool, fn func(models.Thread) error) error {
+	var rows pgx.Rows
+	var err error
+
+	if since != "" {
+		if desc {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserThreadsBeforeStmt), nickname, since, limit)
+		} else {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserThreadsAfterStmt), nickname, since, limit)
+		}
 	} else {
-		row = models.DB.QueryRow(`UPDATE threads SET message=COALESCE(NULLIF($1, ''), message),
-		title=COALESCE(NULLIF($2, ''), title) WHERE LOWER(slug) = LOWER($3) RETURNING *;`, thread.Message, thread.Title, thread.Slug.String)
+		if desc {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserThreadsDescStmt), nickname, limit)
+		} else {
+			rows, err = readDB(ctx).Query(ctx, stmt(selectUserThreadsStmt), nickname, limit)
+		}
 	}
 
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		th, err := scanThread(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(th); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// UpdateThread only applies when thread.Version is zero or still current;
+// otherwise it returns the current thread with errVersionConflict.
+func UpdateThread(ctx context.Context, thread models.Thread) (models.Thread, error) {
+	var row pgx.Row
 	var th models.Thread
-	err := row.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes)
-	return th, err
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return th, err
+	}
+	defer tx.Rollback(ctx)
+
+	if thread.ID > 0 {
+		row = tx.QueryRow(ctx, stmt(updateThreadByIDStmt), thread.Message, thread.Title, thread.ID, thread.Version)
+	} else {
+		row = tx.QueryRow(ctx, stmt(updateThreadBySlugStmt),
+			thread.Message, thread.Title, thread.Slug.String, thread.Version)
+	}
+
+	th, err = scanThread(row)
+	if err == pgx.ErrNoRows && thread.Version != 0 {
+		th, err = scanThread(tx.QueryRow(ctx, stmt(selectThreadStmt), thread.ID, thread.Slug.String))
+		if err == nil {
+			err = errVersionConflict
+		}
+	}
+	if err != nil {
+		return th, err
+	}
+
+	err = AppendEvent(ctx, tx, models.EventThreadUpdated, strconv.Itoa(th.ID), th)
+	if err != nil {
+		return th, err
+	}
+
+	err = invalidateCache(ctx, tx, threadCacheKey(th.ID))
+	if err != nil {
+		return th, err
+	}
+
+	return th, tx.Commit(ctx)
+}
+
+func InsertVote(ctx context.Context, vote models.Vote) error {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, stmt(insertVoteStmt), vote.Nickname, vote.Voice, vote.Thread)
+	if err != nil {
+		return err
+	}
+
+	err = AppendEvent(ctx, tx, models.EventVoteCreated, voteEntity(vote), votePayload(vote))
+	if err != nil {
+		return err
+	}
+
+	err = invalidateCache(ctx, tx, threadCacheKey(vote.Thread))
+	if err != nil {
+		return err
+	}
+
+	err = storeVoteResult(ctx, tx, vote.Thread)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
-func InsertVote(vote models.Vote) error {
-	_, err := models.DB.Exec(`INSERT INTO votes(nickname, voice, thread) VALUES ($1, $2, NULLIF($3, 0));`, vote.Nickname, vote.Voice, vote.Thread)
-	return err
+func UpdateVote(ctx context.Context, vote models.Vote) error {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, stmt(updateVoteStmt), vote.Voice, vote.Nickname, vote.Thread)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() > 0 {
+		err = AppendEvent(ctx, tx, models.EventVoteUpdated, voteEntity(vote), votePayload(vote))
+		if err != nil {
+			return err
+		}
+
+		err = invalidateCache(ctx, tx, threadCacheKey(vote.Thread))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = storeVoteResult(ctx, tx, vote.Thread)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// storeVoteResult stores the answer to an idempotent vote: the thread as the
+// vote left it.
+func storeVoteResult(ctx context.Context, tx pgx.Tx, thread int) error {
+	if _, ok := ctx.Value(idempotencyClaimKey).(*idempotencyClaim); !ok {
+		return nil
+	}
+
+	th, err := scanThread(tx.QueryRow(ctx, stmt(selectThreadByIDStmt), thread))
+	if err != nil {
+		return err
+	}
+	return storeIdempotentResult(ctx, tx, th)
 }
 
-func UpdateVote(vote models.Vote) error {
-	_, err := models.DB.Exec(`UPDATE votes SET voice=$1 WHERE LOWER(nickname)=LOWER($2) AND thread=$3;`, vote.Voice, vote.Nickname, vote.Thread)
-	return err
+func voteEntity(vote models.Vote) string {
+	return strconv.Itoa(vote.Thread) + "/" + vote.Nickname
+}
+
+func votePayload(vote models.Vote) map[string]interface{} {
+	return map[string]interface{}{
+		"nickname": vote.Nickname,
+		"voice":    vote.Voice,
+		"thread":   vote.Thread,
+	}
 }
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// trendingHorizon is how many half-lives back a thread or post still counts;
+// past it a contribution is below one sixteenth.
+const trendingHorizon = 4
+
+// Trending settings, see the trending-* flags.
+var (
+	// TrendingHalfLife is how long it takes a vote or a post to count half.
+	TrendingHalfLife = 24 * time.Hour
+
+	// TrendingVoteWeight and TrendingPostWeight scale a thread's votes and
+	// its recent posts in the score.
+	TrendingVoteWeight = 1.0
+	TrendingPostWeight = 1.0
+
+	// TrendingRefreshEvery is how often the scores are recomputed.
+	TrendingRefreshEvery = time.Minute
+)
+
+// RunTrendingRefresher recomputes trending scores until the process exits.
+func RunTrendingRefresher() {
+	ctx := context.Background()
+	for {
+		_, err := RefreshTrending(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(TrendingRefreshEvery)
+	}
+}
+
+func ForumTrending(ctx *fasthttp.RequestCtx) {
+	forumnameInterface := ctx.UserValue("forumname")
+
+	var forum string
+	switch forumnameInterface.(type) {
+	case string:
+		forum = forumnameInterface.(string)
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := SelectForum(ctx, forum); err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't find forum"))
+		return
+	}
+
+	trending(ctx, forum)
+}
+
+func SiteTrending(ctx *fasthttp.RequestCtx) {
+	trending(ctx, "")
+}
+
+func trending(ctx *fasthttp.RequestCtx, forum string) {
+	limitParam := string(ctx.QueryArgs().Peek("limit"))
+	limit := 100
+	var err error
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit = listLimit(limit)
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectTrending(ctx, forum, limit, func(tt models.TrendingThread) error {
+			return emit(tt)
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"forum_dbms/models"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	// The advisory lock held while thread_trending is rebuilt, so that only
+	// one instance does it at a time, is keyed by the table's own oid.
+	lockTrendingStmt = statement("lockTrending", `SELECT pg_try_advisory_xact_lock('thread_trending'::regclass::oid::bigint);`)
+
+	deleteTrendingStmt = statement("deleteTrending", `DELETE FROM thread_trending;`)
+
+	// A thread is a candidate while it is younger than $4 seconds or has
+	// posts that are. Its votes fade with its age and every recent post adds
+	// a share that fades with the post's age, both halving every $1 seconds.
+	// Exponents are capped at 1000 half-lives, where the factor is already
+	// ~1e-301: past 1074 power() underflows and Postgres raises an error.
+	insertTrendingStmt = statement("insertTrending", `WITH velocity AS (
+			SELECT thread, SUM(power(0.5, LEAST(GREATEST(extract(epoch FROM now() - created), 0) / $1::float8, 1000))) AS posts
+			FROM posts WHERE created > now() - make_interval(secs => $4::float8) GROUP BY thread
+		), candidates AS (
+			SELECT id FROM threads WHERE created > now() - make_interval(secs => $4::float8)
+			UNION
+			SELECT thread FROM velocity
+		)
+		INSERT INTO thread_trending (thread, forum, score)
+		SELECT t.id, t.forum,
+			$2::float8 * t.votes * power(0.5, LEAST(GREATEST(extract(epoch FROM now() - t.created), 0) / $1::float8, 1000))
+			+ $3::float8 * COALESCE(v.posts, 0)
+		FROM candidates c JOIN threads t ON t.id = c.id LEFT JOIN velocity v ON v.thread = t.id;`)
+
+	selectForumTrendingStmt = statement("selectForumTrending", `SELECT `+threadColumns+`, score FROM threads JOIN (
+			SELECT thread, score FROM thread_trending WHERE LOWER(forum)=LOWER($1)
+			ORDER BY score DESC, thread LIMIT NULLIF($2, 0)) tt ON tt.thread = threads.id
+		ORDER BY score DESC, id;`)
+
+	selectTrendingStmt = statement("selectTrending", `SELECT `+threadColumns+`, score FROM threads JOIN (
+			SELECT thread, score FROM thread_trending ORDER BY score DESC, thread LIMIT NULLIF($1, 0)) tt ON tt.thread = threads.id
+		ORDER BY score DESC, id;`)
+)
+
+// RefreshTrending rebuilds thread_trending. It returns false without doing
+// anything when another instance is already at it.
+func RefreshTrending(ctx context.Context) (bool, error) {
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	err = tx.QueryRow(ctx, stmt(lockTrendingStmt)).Scan(&locked)
+	if err != nil || !locked {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, stmt(deleteTrendingStmt))
+	if err != nil {
+		return false, err
+	}
+
+	halfLife := TrendingHalfLife.Seconds()
+	_, err = tx.Exec(ctx, stmt(insertTrendingStmt), halfLife, TrendingVoteWeight, TrendingPostWeight,
+		halfLife*trendingHorizon)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// SelectTrending lists the top threads of the last refresh, of one forum or,
+// when forum is empty, of all of them.
+func SelectTrending(ctx context.Context, forum string, limit int, fn func(models.TrendingThread) error) error {
+	var rows pgx.Rows
+	var err error
+	if forum != "" {
+		rows, err = readDB(ctx).Query(ctx, stmt(selectForumTrendingStmt), forum, limit)
+	} else {
+		rows, err = readDB(ctx).Query(ctx, stmt(selectTrendingStmt), limit)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tt models.TrendingThread
+		th := &tt.Thread
+		err = rows.Scan(&th.Author, &th.Created, &th.Forum, &th.ID, &th.Message, &th.Slug, &th.Title, &th.Votes,
+			&th.Posts, &th.LastPostAt, &th.PostsEdited, &th.Version, &th.Updated, &tt.Score)
+		if err != nil {
+			return err
+		}
+		if err = fn(tt); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
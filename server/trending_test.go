@@ -0,0 +1,44 @@
+package server
+
+import (
+	"forum_dbms/models"
+	"testing"
+	"time"
+)
+
+func TestTrendingRanksOldThreadsWithNewPosts(t *testing.T) {
+	ctx := testDB(t)
+	testUser(t, ctx, "author")
+	testForum(t, ctx, "old", "author")
+	// Ten years is far more half-lives than power(0.5, x) can take before it
+	// underflows.
+	thread := testThread(t, ctx, "old", "author", time.Now().AddDate(-10, 0, 0))
+	err := InsertVote(ctx, models.Vote{Nickname: "author", Voice: 1, Thread: thread.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InsertPosts(ctx, []models.Post{{Author: "author", Message: "still going"}}, thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := RefreshTrending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refreshed {
+		t.Fatal("RefreshTrending did not take its lock")
+	}
+
+	var trending []models.TrendingThread
+	err = SelectTrending(ctx, "old", 10, func(tt models.TrendingThread) error {
+		trending = append(trending, tt)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trending) != 1 || trending[0].ID != thread.ID || trending[0].Score <= 0 {
+		t.Fatalf("trending = %+v, want the old thread with a positive score", trending)
+	}
+}
@@ -1,18 +1,18 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"forum_dbms/models"
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgconn"
+	"github.com/mailru/easyjson"
 	"github.com/valyala/fasthttp"
 	"log"
 	"net/http"
+	"strconv"
 	_ "strings"
 )
 
 func jsonToMessage(message string) []byte {
-	jsonError, err := json.Marshal(models.Error{Message: message})
+	jsonError, err := easyjson.Marshal(models.Error{Message: message})
 	if err != nil {
 		return []byte("")
 	}
@@ -32,42 +32,26 @@ func CreateUser(ctx *fasthttp.RequestCtx) {
 	}
 
 	var user models.User
-	err := json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&user)
+	err := easyjson.Unmarshal(ctx.Request.Body(), &user)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	user.Nickname = nickname
 
-	err = InsertUser(user)
+	created, err := InsertUser(ctx, user)
 	if err != nil {
-		users, err := SelectUsers(user.Email, user.Nickname)
+		users, err := SelectUsers(ctx, user.Email, user.Nickname)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 
-		body, err := json.Marshal(users)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		ctx.SetStatusCode(http.StatusConflict)
-		ctx.SetContentType("application/json")
-		ctx.SetBody(body)
+		writeJSON(ctx, http.StatusConflict, models.Users(users))
 		return
 	}
 
-	body, err := json.Marshal(user)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	ctx.SetStatusCode(http.StatusCreated)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusCreated, created)
 }
 
 func GetUserProfile(ctx *fasthttp.RequestCtx) {
@@ -83,7 +67,7 @@ func GetUserProfile(ctx *fasthttp.RequestCtx) {
 	}
 
 
-	user, err := SelectUserByNickname(nickname)
+	user, err := SelectUserByNickname(ctx, nickname)
 	if err != nil {
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetContentType("application/json")
@@ -91,15 +75,11 @@ func GetUserProfile(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(user)
-	if err != nil {
-		log.Println(err)
+	if notModified(ctx, userTag(user), user.Updated) {
 		return
 	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, user)
 }
 
 func EditUser(ctx *fasthttp.RequestCtx) {
@@ -116,16 +96,23 @@ func EditUser(ctx *fasthttp.RequestCtx) {
 
 
 	var userUpdate models.User
-	err := json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&userUpdate)
+	err := easyjson.Unmarshal(ctx.Request.Body(), &userUpdate)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
 	userUpdate.Nickname = nickname
-	user, err := UpdateUser(userUpdate)
+	userUpdate.Version = expectedVersion(ctx, userUpdate.Version, func(version int64) string {
+		return userTag(models.User{Nickname: nickname, Version: version})
+	})
+	user, err := UpdateUser(ctx, userUpdate)
 	if err != nil {
-		if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" {
+		if err == errVersionConflict {
+			preconditionFailed(ctx, user, userTag(user))
+			return
+		}
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
 			ctx.SetStatusCode(http.StatusConflict)
 			ctx.SetContentType("application/json")
 			ctx.SetBody(jsonToMessage("This email is already registered"))
@@ -137,13 +124,226 @@ func EditUser(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	body, err := json.Marshal(user)
+	ctx.Response.Header.Set("ETag", userTag(user))
+	writeJSON(ctx, http.StatusOK, user)
+}
+
+// userActivityParams reads the nickname and the limit, since and desc
+// parameters shared by the user activity listings, answering the request
+// itself when it can't go on.
+func userActivityParams(ctx *fasthttp.RequestCtx) (string, string, int, bool, bool) {
+	usernameInterface := ctx.UserValue("username")
+	var nickname string
+
+	switch usernameInterface.(type) {
+	case string:
+		nickname = usernameInterface.(string)
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return "", "", 0, false, false
+	}
+
+	queryParams := ctx.QueryArgs()
+
+	limitParam := string(queryParams.Peek("limit"))
+	limit := 100
+	var err error
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return "", "", 0, false, false
+		}
+	}
+
+	desc := string(queryParams.Peek("desc")) == "true"
+	since := string(queryParams.Peek("since"))
+
+	user, err := SelectUserByNickname(ctx, nickname)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't find user"))
+		return "", "", 0, false, false
+	}
+
+	return user.Nickname, since, listLimit(limit), desc, true
+}
+
+func UserThreads(ctx *fasthttp.RequestCtx) {
+	nickname, since, limit, desc, ok := userActivityParams(ctx)
+	if !ok {
+		return
+	}
+
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectThreadsByAuthor(ctx, nickname, since, limit, desc, func(th models.Thread) error {
+			return emit(th)
+		})
+	})
+}
+
+func UserPosts(ctx *fasthttp.RequestCtx) {
+	nickname, since, limit, desc, ok := userActivityParams(ctx)
+	if !ok {
+		return
+	}
+
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectPostsByAuthor(ctx, nickname, since, limit, desc, func(p models.Post) error {
+			return emit(p)
+		})
+	})
+}
+
+func UserForums(ctx *fasthttp.RequestCtx) {
+	nickname, since, limit, desc, ok := userActivityParams(ctx)
+	if !ok {
+		return
+	}
+
+	streamJSONArray(ctx, func(emit func(easyjson.Marshaler) error) error {
+		return SelectForumsByUser(ctx, nickname, since, limit, desc, func(f models.Forum) error {
+			return emit(f)
+		})
+	})
+}
+
+// userSortValue is the value of the sort column of user, as its cursor
+// carries it.
+func userSortValue(sort string, user models.User) string {
+	if sort == "fullname" {
+		return user.Fullname
+	}
+	return user.Nickname
+}
+
+// ListUsers is the user directory. It pages through all users, those whose
+// nickname or fullname starts with q, or with match=similar those whose
+// nickname or fullname resembles q, most similar first. Admins may look a user
+// up by email instead.
+func ListUsers(ctx *fasthttp.RequestCtx) {
+	queryParams := ctx.QueryArgs()
+
+	if email := string(queryParams.Peek("email")); email != "" {
+		if !isAdmin(ctx) {
+			ctx.SetStatusCode(http.StatusForbidden)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Only admins can look users up by email"))
+			return
+		}
+
+		users, err := SelectUsers(ctx, email, "")
+		if err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		if users == nil {
+			users = []models.User{}
+		}
+		writeJSON(ctx, http.StatusOK, models.Users(users))
+		return
+	}
+
+	limitParam := string(queryParams.Peek("limit"))
+	limit := 100
+	var err error
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+	}
+	limit = listLimit(limit)
+
+	desc := string(queryParams.Peek("desc")) == "true"
+	query := string(queryParams.Peek("q"))
+	match := string(queryParams.Peek("match"))
+	sort := string(queryParams.Peek("sort"))
+	cursor := string(queryParams.Peek("cursor"))
+
+	var users []models.User
+	var next string
+	switch match {
+	case "similar":
+		if query == "" || (sort != "" && sort != "relevance") {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Similar users are found by q and listed by relevance"))
+			return
+		}
+
+		var afterScore float32
+		var afterNickname string
+		afterNickname, err = decodeCursor(cursor, "relevance", &afterScore)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Invalid cursor"))
+			return
+		}
+
+		// One user past the page tells whether there is a next one.
+		var scores []float32
+		users, scores, err = SearchUsers(ctx, query, afterScore, afterNickname, limit+1)
+		if err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		if len(users) > limit {
+			users = users[:limit]
+			next, err = encodeCursor("relevance", scores[limit-1], users[limit-1].Nickname)
+		}
+	case "", "prefix":
+		if sort == "" {
+			sort = "nickname"
+		}
+		if _, ok := userDirectorySorts[sort]; !ok {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Unknown sort " + sort))
+			return
+		}
+
+		var afterValue string
+		var afterNickname string
+		afterNickname, err = decodeCursor(cursor, sort, &afterValue)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Invalid cursor"))
+			return
+		}
+
+		users, err = SelectUserDirectory(ctx, sort, query, afterValue, afterNickname, limit+1, desc)
+		if err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		if len(users) > limit {
+			users = users[:limit]
+			last := users[limit-1]
+			next, err = encodeCursor(sort, userSortValue(sort, last), last.Nickname)
+		}
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Unknown match " + match))
+		return
+	}
+
 	if err != nil {
 		log.Println(err)
+		ctx.SetStatusCode(http.StatusInternalServerError)
 		return
 	}
+	if next != "" {
+		ctx.Response.Header.Set("X-Next-Cursor", next)
+	}
 
-	ctx.SetStatusCode(http.StatusOK)
-	ctx.SetContentType("application/json")
-	ctx.SetBody(body)
+	writeJSON(ctx, http.StatusOK, models.Users(users))
 }
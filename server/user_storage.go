@@ -1,28 +1,110 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"forum_dbms/models"
+	"strings"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v4"
 )
 
-func InsertUser(user models.User) error {
-	_, err := models.DB.Exec(`INSERT INTO users(about, email, fullname, nickname) VALUES ($1, $2, $3, $4);`,
-		user.About, user.Email, user.Fullname, user.Nickname)
-	return err
+var (
+	insertUserStmt = statement("insertUser", `INSERT INTO users(about, email, fullname, nickname) VALUES ($1, $2, $3, $4)
+		RETURNING `+userColumns+`;`)
+
+	selectUsersStmt = statement("selectUsers", `SELECT `+userColumns+` FROM users WHERE LOWER(email)=LOWER($1)
+		OR LOWER(nickname)=LOWER($2) LIMIT 2;`)
+
+	selectUserByNicknameStmt = statement("selectUserByNickname", `SELECT `+userColumns+` FROM users WHERE LOWER(nickname)=LOWER($1) LIMIT 1;`)
+
+	updateUserStmt = statement("updateUser", `UPDATE users SET about=COALESCE(NULLIF($1, ''), about),
+		email=COALESCE(NULLIF($2, ''), email), 	fullname=COALESCE(NULLIF($3, ''), fullname)
+		WHERE LOWER(nickname)=LOWER($4) AND ($5 = 0 OR version = $5) RETURNING `+userColumns+`;`)
+
+	selectForumUsersDescSinceStmt = statement("selectForumUsersDescSince", `SELECT about, email, fullname, nickname FROM users_forum
+		WHERE slug=$1 AND nickname < $2 ORDER BY nickname DESC LIMIT NULLIF($3, 0);`)
+
+	selectForumUsersDescStmt = statement("selectForumUsersDesc", `SELECT about, email, fullname, nickname FROM users_forum
+		WHERE slug=$1 ORDER BY nickname DESC LIMIT NULLIF($2, 0);`)
+
+	selectForumUsersSinceStmt = statement("selectForumUsersSince", `SELECT about, email, fullname, nickname FROM users_forum
+		WHERE slug=$1 AND nickname > $2 ORDER BY nickname LIMIT NULLIF($3, 0);`)
+
+	searchUsersStmt = statement("searchUsers", `SELECT `+userColumns+`, score FROM (
+		SELECT `+userColumns+`, GREATEST(similarity(nickname::text, $1), similarity(fullname, $1)) AS score
+		FROM users WHERE nickname::text % $1 OR fullname % $1) u
+		WHERE $2::citext = '' OR score < $3 OR (score = $3 AND nickname > $2)
+		ORDER BY score DESC, nickname LIMIT NULLIF($4, 0);`)
+)
+
+// userDirectorySorts maps every sort of the user directory to the column it
+// orders by; nickname breaks ties.
+var userDirectorySorts = map[string]string{
+	"nickname": "nickname",
+	"fullname": "fullname",
+}
+
+// userDirectoryStmts holds, for every sort, the ascending and the descending
+// listing of all users and then of those whose nickname or fullname starts
+// with the pattern in $4. ($2, $1) is the position to continue after.
+var userDirectoryStmts = func() map[string][4]string {
+	stmts := make(map[string][4]string, len(userDirectorySorts))
+	for sort, column := range userDirectorySorts {
+		var names [4]string
+		for i, variant := range []struct{ name, cmp, order, filter string }{
+			{"", ">", "", ""},
+			{"Desc", "<", " DESC", ""},
+			{"Prefix", ">", "", "AND (nickname::text ILIKE $4 OR fullname ILIKE $4)"},
+			{"PrefixDesc", "<", " DESC", "AND (nickname::text ILIKE $4 OR fullname ILIKE $4)"},
+		} {
+			names[i] = statement("selectUserDirectory"+variant.name+"_"+sort, fmt.Sprintf(`SELECT `+userColumns+` FROM users
+				WHERE ($1::citext = '' OR (%[1]s, nickname) %[2]s ($2, $1)) %[4]s
+				ORDER BY %[1]s%[3]s, nickname%[3]s LIMIT NULLIF($3, 0);`, column, variant.cmp, variant.order, variant.filter))
+		}
+		stmts[sort] = names
+	}
+	return stmts
+}()
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func InsertUser(ctx context.Context, user models.User) (models.User, error) {
+	var u models.User
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return u, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, stmt(insertUserStmt), user.About, user.Email, user.Fullname, user.Nickname)
+	u, err = scanUser(row)
+	if err != nil {
+		return u, err
+	}
+
+	err = AppendEvent(ctx, tx, models.EventUserCreated, u.Nickname, u)
+	if err != nil {
+		return u, err
+	}
+
+	err = storeIdempotentResult(ctx, tx, u)
+	if err != nil {
+		return u, err
+	}
+
+	return u, tx.Commit(ctx)
 }
 
-func SelectUsers(email, nickname string) ([]models.User, error) {
+func SelectUsers(ctx context.Context, email, nickname string) ([]models.User, error) {
 	var users []models.User
-	rows, err := models.DB.Query(`SELECT * FROM users WHERE LOWER(email)=LOWER($1)
-	OR LOWER(nickname)=LOWER($2) LIMIT 2;`, email, nickname)
+	rows, err := models.DB.Query(ctx, stmt(selectUsersStmt), email, nickname)
 	if err != nil {
 		return users, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var u models.User
-		err = rows.Scan(&u.About, &u.Email, &u.Fullname, &u.Nickname)
+		u, err := scanUser(rows)
 		if err != nil {
 			return users, err
 		}
@@ -31,43 +113,71 @@ func SelectUsers(email, nickname string) ([]models.User, error) {
 	return users, nil
 }
 
-func SelectUserByNickname(nickname string) (models.User, error) {
-	row := models.DB.QueryRow(`SELECT * FROM users WHERE LOWER(nickname)=LOWER($1) LIMIT 1;`, nickname)
-	var u models.User
-	err := row.Scan(&u.About, &u.Email, &u.Fullname, &u.Nickname)
+func SelectUserByNickname(ctx context.Context, nickname string) (models.User, error) {
+	if cached, ok := userCache.get(userCacheKey(nickname)); ok {
+		return cached.(models.User), nil
+	}
+
+	row := models.DB.QueryRow(ctx, stmt(selectUserByNicknameStmt), nickname)
+	u, err := scanUser(row)
+	if err == nil {
+		userCache.set(userCacheKey(u.Nickname), u)
+	}
 	return u, err
 }
 
-func UpdateUser(user models.User) (models.User, error) {
-	row := models.DB.QueryRow(`UPDATE users SET about=COALESCE(NULLIF($1, ''), about),
-				email=COALESCE(NULLIF($2, ''), email), 	fullname=COALESCE(NULLIF($3, ''), fullname)
-				WHERE LOWER(nickname)=LOWER($4) RETURNING *;`, user.About, user.Email, user.Fullname, user.Nickname)
-
+// UpdateUser only applies when user.Version is zero or still current;
+// otherwise it returns the current user with errVersionConflict.
+func UpdateUser(ctx context.Context, user models.User) (models.User, error) {
 	var u models.User
-	err := row.Scan(&u.About, &u.Email, &u.Fullname, &u.Nickname)
-	return u, err
+	tx, err := models.DB.Begin(ctx)
+	if err != nil {
+		return u, err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, stmt(updateUserStmt), user.About, user.Email, user.Fullname, user.Nickname, user.Version)
+
+	u, err = scanUser(row)
+	if err == pgx.ErrNoRows && user.Version != 0 {
+		u, err = scanUser(tx.QueryRow(ctx, stmt(selectUserByNicknameStmt), user.Nickname))
+		if err == nil {
+			err = errVersionConflict
+		}
+	}
+	if err != nil {
+		return u, err
+	}
+
+	err = AppendEvent(ctx, tx, models.EventUserUpdated, u.Nickname, u)
+	if err != nil {
+		return u, err
+	}
+
+	err = invalidateCache(ctx, tx, userCacheKey(u.Nickname))
+	if err != nil {
+		return u, err
+	}
+
+	return u, tx.Commit(ctx)
 }
 
-func SelectUsersByForum(slug, since string, limit int, desc bool) ([]models.User, error) {
-	var users []models.User
-	var rows *pgx.Rows
+func SelectUsersByForum(ctx context.Context, slug, since string, limit int, desc bool, fn func(models.User) error) error {
+	var rows pgx.Rows
 	var err error
 
 	if desc {
 		if since != "" {
-			rows, err = models.DB.Query(`SELECT about, email, fullname, nickname FROM users_forum
-				WHERE slug=$1 AND nickname < $2 ORDER BY nickname DESC LIMIT NULLIF($3, 0);`, slug, since, limit)
+			rows, err = readDB(ctx).Query(ctx, stmt(selectForumUsersDescSinceStmt), slug, since, limit)
 		} else {
-			rows, err = models.DB.Query(`SELECT about, email, fullname, nickname FROM users_forum
-				WHERE slug=$1 ORDER BY nickname DESC LIMIT NULLIF($2, 0);`, slug, limit)
+			rows, err = readDB(ctx).Query(ctx, stmt(selectForumUsersDescStmt), slug, limit)
 		}
 	} else {
-		rows, err = models.DB.Query(`SELECT about, email, fullname, nickname FROM users_forum
-			WHERE slug=$1 AND nickname > $2 ORDER BY nickname LIMIT NULLIF($3, 0);`, slug, since, limit)
+		rows, err = readDB(ctx).Query(ctx, stmt(selectForumUsersSinceStmt), slug, since, limit)
 	}
 
 	if err != nil {
-		return users, err
+		return err
 	}
 	defer rows.Close()
 
@@ -75,10 +185,71 @@ func SelectUsersByForum(slug, since string, limit int, desc bool) ([]models.User
 		var u models.User
 		err = rows.Scan(&u.About, &u.Email, &u.Fullname, &u.Nickname)
 		if err != nil {
-			return users, err
+			return err
+		}
+		if err = fn(u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SelectUserDirectory lists users in the given sort, only those whose nickname
+// or fullname starts with prefix when it is set. A page continues after the
+// user afterNickname, whose sort column holds afterValue.
+func SelectUserDirectory(ctx context.Context, sort, prefix string, afterValue interface{}, afterNickname string,
+	limit int, desc bool) ([]models.User, error) {
+	variant := 0
+	if desc {
+		variant = 1
+	}
+
+	var rows pgx.Rows
+	var err error
+	if prefix != "" {
+		rows, err = readDB(ctx).Query(ctx, stmt(userDirectoryStmts[sort][variant+2]), afterNickname, afterValue, limit,
+			likeEscaper.Replace(prefix)+"%")
+	} else {
+		rows, err = readDB(ctx).Query(ctx, stmt(userDirectoryStmts[sort][variant]), afterNickname, afterValue, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]models.User, 0, limit)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
 		}
 		users = append(users, u)
 	}
+	return users, rows.Err()
+}
 
-	return users, nil
+// SearchUsers lists the users whose nickname or fullname is similar to query,
+// most similar first, along with how similar each one is. A page continues
+// after the user afterNickname, whose score was afterScore.
+func SearchUsers(ctx context.Context, query string, afterScore float32, afterNickname string,
+	limit int) ([]models.User, []float32, error) {
+	rows, err := readDB(ctx).Query(ctx, stmt(searchUsersStmt), query, afterNickname, afterScore, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	users := make([]models.User, 0, limit)
+	scores := make([]float32, 0, limit)
+	for rows.Next() {
+		var u models.User
+		var score float32
+		err = rows.Scan(&u.About, &u.Email, &u.Fullname, &u.Nickname, &u.Version, &u.Updated, &score)
+		if err != nil {
+			return nil, nil, err
+		}
+		users = append(users, u)
+		scores = append(scores, score)
+	}
+	return users, scores, rows.Err()
 }
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"forum_dbms/models"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+)
+
+func TestForumUsersFollowProfileEdits(t *testing.T) {
+	ctx := testDB(t)
+	testUser(t, ctx, "author")
+	testForum(t, ctx, "people", "author")
+	thread := testThread(t, ctx, "people", "author", time.Now())
+	_, err := InsertPosts(ctx, []models.Post{{Author: "author", Message: "hello"}}, thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edit := testRequest(fasthttp.MethodPost, "/api/user/author/profile",
+		`{"fullname":"Renamed Author","about":"edited"}`, map[string]string{"username": "author"})
+	EditUser(edit)
+	if status := edit.Response.StatusCode(); status != http.StatusOK {
+		t.Fatalf("edit = %d, want %d: %s", status, http.StatusOK, edit.Response.Body())
+	}
+
+	list := testRequest(fasthttp.MethodGet, "/api/forum/people/users", "", map[string]string{"forumname": "people"})
+	ForumUsers(list)
+	if status := list.Response.StatusCode(); status != http.StatusOK {
+		t.Fatalf("forum users = %d, want %d: %s", status, http.StatusOK, list.Response.Body())
+	}
+
+	var users models.Users
+	err = easyjson.Unmarshal(list.Response.Body(), &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("forum has %d users, want 1: %s", len(users), list.Response.Body())
+	}
+	if users[0].Fullname != "Renamed Author" || users[0].About != "edited" {
+		t.Fatalf("forum user = %+v, want the edited profile", users[0])
+	}
+}
+
+func TestListUsersByUnknownEmail(t *testing.T) {
+	testDB(t)
+	AdminToken = "test-token"
+	defer func() { AdminToken = "" }()
+
+	list := testRequest(fasthttp.MethodGet, "/api/users?email=nobody@example.com", "", nil)
+	list.Request.Header.Set("Authorization", "Bearer "+AdminToken)
+	ListUsers(list)
+	if status := list.Response.StatusCode(); status != http.StatusOK {
+		t.Fatalf("lookup = %d, want %d: %s", status, http.StatusOK, list.Response.Body())
+	}
+	if body := string(list.Response.Body()); body != "[]" {
+		t.Fatalf("lookup of an unknown email = %s, want []", body)
+	}
+}
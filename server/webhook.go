@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"forum_dbms/models"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// CreateWebhook registers a receiver for the forum's events. It is admin-only:
+// the API has no credentials for forum owners, and a webhook makes the server
+// send requests wherever it points.
+func CreateWebhook(ctx *fasthttp.RequestCtx) {
+	if !isAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Only admins can register webhooks"))
+		return
+	}
+
+	forumnameInterface := ctx.UserValue("forumname")
+
+	var slug string
+	switch forumnameInterface.(type) {
+	case string:
+		slug = forumnameInterface.(string)
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	var webhook models.Webhook
+	err := json.NewDecoder(bytes.NewReader(ctx.Request.Body())).Decode(&webhook)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	target, err := url.Parse(webhook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Webhook url must be an absolute http(s) url"))
+		return
+	}
+	if _, err := webhookIPs(ctx, target.Hostname()); err != nil {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Webhook url must resolve to a public address"))
+		return
+	}
+
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Println(err)
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook.Forum = slug
+	webhookInserted, err := InsertWebhook(ctx, webhook)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); errors.Is(err, pgx.ErrNoRows) || ok && pgErr.Code == "23503" {
+			ctx.SetStatusCode(http.StatusNotFound)
+			ctx.SetContentType("application/json")
+			ctx.SetBody(jsonToMessage("Can't find forum"))
+			return
+		}
+		log.Println(err)
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(webhookInserted)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusCreated)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+func ForumWebhooks(ctx *fasthttp.RequestCtx) {
+	if !isAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Only admins can list webhooks"))
+		return
+	}
+
+	forumnameInterface := ctx.UserValue("forumname")
+
+	var slug string
+	switch forumnameInterface.(type) {
+	case string:
+		slug = forumnameInterface.(string)
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := SelectForum(ctx, slug); err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't find forum"))
+		return
+	}
+
+	webhooks, err := SelectWebhooks(ctx, slug)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(webhooks) == 0 {
+		ctx.SetStatusCode(http.StatusOK)
+		ctx.SetContentType("application/json")
+		ctx.SetBody([]byte("[]"))
+		return
+	}
+
+	body, err := json.Marshal(webhooks)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+func WebhookDeliveries(ctx *fasthttp.RequestCtx) {
+	if !isAdmin(ctx) {
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Only admins can list webhook deliveries"))
+		return
+	}
+
+	forumnameInterface := ctx.UserValue("forumname")
+
+	var slug string
+	switch forumnameInterface.(type) {
+	case string:
+		slug = forumnameInterface.(string)
+	default:
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	queryParams := ctx.QueryArgs()
+
+	limitParam := string(queryParams.Peek("limit"))
+	limit := 100
+	var err error
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+	}
+
+	status := string(queryParams.Peek("status"))
+
+	if _, err := SelectForum(ctx, slug); err != nil {
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(jsonToMessage("Can't find forum"))
+		return
+	}
+
+	deliveries, err := SelectWebhookDeliveries(ctx, slug, status, limit)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(deliveries) == 0 {
+		ctx.SetStatusCode(http.StatusOK)
+		ctx.SetContentType("application/json")
+		ctx.SetBody([]byte("[]"))
+		return
+	}
+
+	body, err := json.Marshal(deliveries)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
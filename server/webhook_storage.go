@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"forum_dbms/models"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	insertWebhookStmt = statement("insertWebhook", `INSERT INTO webhooks(forum, url, secret, events) VALUES ($1, $2, $3, $4)
+		RETURNING id, forum, url, secret, events, created;`)
+
+	selectWebhooksStmt = statement("selectWebhooks", `SELECT id, forum, url, events, created FROM webhooks
+		WHERE LOWER(forum)=LOWER($1) ORDER BY id;`)
+
+	selectWebhookDeliveriesStmt = statement("selectWebhookDeliveries", `SELECT o.id, o.webhook, o.event, o.payload::text, o.status, o.attempts, o.next_attempt,
+		o.last_error, o.response_code, o.created, o.delivered FROM webhook_outbox o JOIN webhooks w ON w.id = o.webhook
+		WHERE LOWER(w.forum)=LOWER($1) AND ($2 = '' OR o.status = $2) ORDER BY o.id DESC LIMIT NULLIF($3, 0);`)
+
+	enqueueWebhookEventStmt = statement("enqueueWebhookEvent", `INSERT INTO webhook_outbox(webhook, event, payload)
+		SELECT id, $2, $3::jsonb FROM webhooks WHERE LOWER(forum)=LOWER($1)
+		AND (cardinality(events) = 0 OR $2 = ANY(events));`)
+
+	enqueueWebhookEventsStmt = statement("enqueueWebhookEvents", `INSERT INTO webhook_outbox(webhook, event, payload)
+		SELECT w.id, $2, p.value FROM webhooks w, jsonb_array_elements($3::jsonb) p
+		WHERE LOWER(w.forum)=LOWER($1) AND (cardinality(w.events) = 0 OR $2 = ANY(w.events));`)
+
+	claimWebhookDeliveriesStmt = statement("claimWebhookDeliveries", `UPDATE webhook_outbox o SET next_attempt = now() + make_interval(secs => $2)
+		FROM webhooks w WHERE w.id = o.webhook AND o.id IN (SELECT id FROM webhook_outbox
+		WHERE status = 'pending' AND next_attempt <= now() ORDER BY next_attempt LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING o.id, o.event, o.payload::text, o.attempts, w.url, w.secret;`)
+
+	markWebhookDeliveredStmt = statement("markWebhookDelivered", `UPDATE webhook_outbox SET status = 'delivered', attempts = attempts + 1,
+		response_code = $2, last_error = NULL, delivered = now() WHERE id = $1;`)
+
+	markWebhookFailedStmt = statement("markWebhookFailed", `UPDATE webhook_outbox SET attempts = attempts + 1, response_code = NULLIF($2, 0), last_error = $3,
+		status = CASE WHEN attempts + 1 >= $5 THEN 'dead' ELSE 'pending' END,
+		next_attempt = now() + make_interval(secs => $4) WHERE id = $1;`)
+)
+
+func InsertWebhook(ctx context.Context, webhook models.Webhook) (models.Webhook, error) {
+	var w models.Webhook
+	forum, err := SelectForum(ctx, webhook.Forum)
+	if err != nil {
+		return w, err
+	}
+
+	events, err := textArray(webhook.Events)
+	if err != nil {
+		return w, err
+	}
+
+	row := models.DB.QueryRow(ctx, stmt(insertWebhookStmt), forum.Slug, webhook.URL, webhook.Secret, events)
+	err = row.Scan(&w.ID, &w.Forum, &w.URL, &w.Secret, &w.Events, &w.Created)
+	return w, err
+}
+
+func SelectWebhooks(ctx context.Context, forum string) ([]models.Webhook, error) {
+	var webhooks []models.Webhook
+	rows, err := models.DB.Query(ctx, stmt(selectWebhooksStmt), forum)
+	if err != nil {
+		return webhooks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var w models.Webhook
+		err = rows.Scan(&w.ID, &w.Forum, &w.URL, &w.Events, &w.Created)
+		if err != nil {
+			return webhooks, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func SelectWebhookDeliveries(ctx context.Context, forum, status string, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	rows, err := models.DB.Query(ctx, stmt(selectWebhookDeliveriesStmt), forum, status, limit)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var payload string
+		err = rows.Scan(&d.ID, &d.Webhook, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttempt,
+			&d.LastError, &d.ResponseCode, &d.Created, &d.Delivered)
+		if err != nil {
+			return deliveries, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// EnqueueWebhookEvent writes one outbox row per matching webhook of the forum.
+// It must run in the same transaction as the change it describes.
+func EnqueueWebhookEvent(ctx context.Context, tx pgx.Tx, forum, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, stmt(enqueueWebhookEventStmt), forum, event, string(data))
+	return err
+}
+
+// EnqueueWebhookEvents is EnqueueWebhookEvent for a batch, one outbox row per element.
+func EnqueueWebhookEvents(ctx context.Context, tx pgx.Tx, forum, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, stmt(enqueueWebhookEventsStmt), forum, event, string(data))
+	return err
+}
+
+// ClaimWebhookDeliveries leases due outbox rows so that concurrent workers skip
+// them. The lease has to outlast the whole batch: a row whose lease runs out is
+// claimed and delivered again by another worker.
+func ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookJob, error) {
+	var jobs []webhookJob
+	rows, err := models.DB.Query(ctx, stmt(claimWebhookDeliveriesStmt), limit, int(lease/time.Second))
+	if err != nil {
+		return jobs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var j webhookJob
+		err = rows.Scan(&j.ID, &j.Event, &j.Payload, &j.Attempts, &j.URL, &j.Secret)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func MarkWebhookDelivered(ctx context.Context, id int64, code int) error {
+	_, err := models.DB.Exec(ctx, stmt(markWebhookDeliveredStmt), id, code)
+	return err
+}
+
+// MarkWebhookFailed schedules the next attempt after backoffSeconds, or moves
+// the row to the dead-letter list once maxAttempts is reached.
+func MarkWebhookFailed(ctx context.Context, id int64, code int, message string, backoffSeconds int, maxAttempts int) error {
+	_, err := models.DB.Exec(ctx, stmt(markWebhookFailedStmt), id, code, message, backoffSeconds, maxAttempts)
+	return err
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"forum_dbms/models"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver answers every delivery with status and hands it to the test.
+func webhookReceiver(t *testing.T, status int) (*httptest.Server, <-chan receivedWebhook) {
+	received := make(chan receivedWebhook, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- receivedWebhook{header: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func allowPrivateWebhooks(t *testing.T) {
+	WebhookAllowPrivate = true
+	t.Cleanup(func() { WebhookAllowPrivate = false })
+}
+
+func createWebhookRequest(body string, admin bool) *fasthttp.RequestCtx {
+	ctx := testRequest(fasthttp.MethodPost, "/api/forum/hooks/webhooks", body, map[string]string{"forumname": "hooks"})
+	if admin {
+		ctx.Request.Header.Set("Authorization", "Bearer "+AdminToken)
+	}
+	return ctx
+}
+
+func TestCreateWebhookRequiresAdmin(t *testing.T) {
+	AdminToken = "test-token"
+	defer func() { AdminToken = "" }()
+
+	ctx := createWebhookRequest(`{"url": "https://example.com/hook"}`, false)
+	CreateWebhook(ctx)
+	if status := ctx.Response.StatusCode(); status != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestWebhookListingsRequireAdmin(t *testing.T) {
+	AdminToken = "test-token"
+	defer func() { AdminToken = "" }()
+
+	for name, handler := range map[string]fasthttp.RequestHandler{
+		"webhooks":   ForumWebhooks,
+		"deliveries": WebhookDeliveries,
+	} {
+		ctx := testRequest(fasthttp.MethodGet, "/api/forum/hooks/webhooks", "", map[string]string{"forumname": "hooks"})
+		handler(ctx)
+		if status := ctx.Response.StatusCode(); status != http.StatusForbidden {
+			t.Errorf("%s without the admin token = %d, want %d", name, status, http.StatusForbidden)
+		}
+	}
+}
+
+func TestCreateWebhookRejectsInternalURLs(t *testing.T) {
+	AdminToken = "test-token"
+	defer func() { AdminToken = "" }()
+
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"http://172.20.1.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://[fd00::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"ftp://example.com/hook",
+	} {
+		ctx := createWebhookRequest(`{"url": "`+target+`"}`, true)
+		CreateWebhook(ctx)
+		if status := ctx.Response.StatusCode(); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", target, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for ip, public := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::248": true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"100.64.0.1":           false,
+		"172.31.255.255":       false,
+		"172.32.0.1":           true,
+		"192.168.0.1":          false,
+		"169.254.169.254":      false,
+		"224.0.0.1":            false,
+		"::1":                  false,
+		"fe80::1":              false,
+		"fc00::1":              false,
+		"::ffff:10.0.0.1":      false,
+	} {
+		if got := publicIP(net.ParseIP(ip)); got != public {
+			t.Errorf("publicIP(%s) = %v, want %v", ip, got, public)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	srv, received := webhookReceiver(t, http.StatusOK)
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(srv.URL)
+	req.Header.SetMethod(fasthttp.MethodPost)
+
+	err := webhookClient.DoTimeout(req, resp, webhookTimeout)
+	if !errors.Is(err, errWebhookAddress) {
+		t.Fatalf("err = %v, want %v", err, errWebhookAddress)
+	}
+	select {
+	case <-received:
+		t.Fatal("receiver on a loopback address was called")
+	default:
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ctx := testDB(t)
+	allowPrivateWebhooks(t)
+	srv, received := webhookReceiver(t, http.StatusNoContent)
+
+	testUser(t, ctx, "owner")
+	forum := testForum(t, ctx, "hooks", "owner")
+	webhook, err := InsertWebhook(ctx, models.Webhook{Forum: forum.Slug, URL: srv.URL, Secret: "s3cret", Events: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := testThread(t, ctx, forum.Slug, "owner", time.Now())
+
+	jobs, err := ClaimWebhookDeliveries(ctx, webhookBatchSize, webhookLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("claimed %d deliveries, want 1", len(jobs))
+	}
+	deliverWebhook(ctx, jobs[0])
+
+	var delivery receivedWebhook
+	select {
+	case delivery = <-received:
+	default:
+		t.Fatal("receiver was not called")
+	}
+	if event := delivery.header.Get("X-Forum-Event"); event != models.EventThreadCreated {
+		t.Errorf("X-Forum-Event = %q, want %q", event, models.EventThreadCreated)
+	}
+	if signature := delivery.header.Get("X-Forum-Signature"); signature != "sha256="+signWebhook(webhook.Secret, delivery.body) {
+		t.Errorf("X-Forum-Signature = %q does not sign the body", signature)
+	}
+
+	var envelope struct {
+		Event string        `json:"event"`
+		Data  models.Thread `json:"data"`
+	}
+	err = json.Unmarshal(delivery.body, &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Data.ID != thread.ID {
+		t.Errorf("delivered thread %d, want %d", envelope.Data.ID, thread.ID)
+	}
+
+	deliveries, err := SelectWebhookDeliveries(ctx, forum.Slug, "delivered", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].ResponseCode.Int64 != http.StatusNoContent {
+		t.Errorf("delivered rows = %+v, want one answered with %d", deliveries, http.StatusNoContent)
+	}
+}
+
+func TestWebhookDeliveryFailureIsRetriedLater(t *testing.T) {
+	ctx := testDB(t)
+	allowPrivateWebhooks(t)
+	srv, received := webhookReceiver(t, http.StatusServiceUnavailable)
+
+	testUser(t, ctx, "owner")
+	forum := testForum(t, ctx, "hooks", "owner")
+	_, err := InsertWebhook(ctx, models.Webhook{Forum: forum.Slug, URL: srv.URL, Secret: "s3cret", Events: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testThread(t, ctx, forum.Slug, "owner", time.Now())
+
+	jobs, err := ClaimWebhookDeliveries(ctx, webhookBatchSize, webhookLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("claimed %d deliveries, want 1", len(jobs))
+	}
+	deliverWebhook(ctx, jobs[0])
+	<-received
+
+	deliveries, err := SelectWebhookDeliveries(ctx, forum.Slug, "pending", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Attempts != 1 || deliveries[0].ResponseCode.Int64 != http.StatusServiceUnavailable {
+		t.Fatalf("pending rows = %+v, want one failed attempt answered with %d", deliveries, http.StatusServiceUnavailable)
+	}
+
+	// The backoff keeps the row from being claimed again right away.
+	jobs, err = ClaimWebhookDeliveries(ctx, webhookBatchSize, webhookLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("claimed %d deliveries during the backoff, want 0", len(jobs))
+	}
+}
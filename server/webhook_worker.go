@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	webhookBatchSize    = 50
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 5 * time.Second
+	webhookMaxBackoff   = time.Hour
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = time.Second
+
+	// webhookLease covers a batch whose every delivery times out, plus a
+	// margin for marking the rows afterwards.
+	webhookLease = webhookBatchSize*webhookTimeout + time.Minute
+)
+
+// WebhookAllowPrivate lets webhooks point at loopback and private networks,
+// for receivers running next to the server during development.
+var WebhookAllowPrivate = false
+
+var webhookClient = &fasthttp.Client{
+	ReadTimeout:  webhookTimeout,
+	WriteTimeout: webhookTimeout,
+	Dial:         dialWebhook,
+}
+
+var errWebhookAddress = errors.New("webhook host resolves to a loopback, private or link-local address")
+
+// privateNetworks are ranges a webhook must not reach besides the loopback,
+// link-local, multicast and unspecified addresses net.IP reports itself.
+var privateNetworks = parseNetworks("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "240.0.0.0/4", "fc00::/7")
+
+type webhookJob struct {
+	ID       int64
+	Event    string
+	Payload  string
+	Attempts int
+	URL      string
+	Secret   string
+}
+
+type webhookEnvelope struct {
+	Delivery int64           `json:"delivery"`
+	Event    string          `json:"event"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// RunWebhookWorker delivers outbox rows until the process exits.
+func RunWebhookWorker() {
+	ctx := context.Background()
+	for {
+		jobs, err := ClaimWebhookDeliveries(ctx, webhookBatchSize, webhookLease)
+		if err != nil {
+			log.Println(err)
+		}
+
+		for _, job := range jobs {
+			deliverWebhook(ctx, job)
+		}
+
+		if len(jobs) < webhookBatchSize {
+			time.Sleep(webhookPollInterval)
+		}
+	}
+}
+
+func deliverWebhook(ctx context.Context, job webhookJob) {
+	body, err := json.Marshal(webhookEnvelope{Delivery: job.ID, Event: job.Event, Data: json.RawMessage(job.Payload)})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(job.URL)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.Header.Set("X-Forum-Event", job.Event)
+	req.Header.Set("X-Forum-Delivery", strconv.FormatInt(job.ID, 10))
+	req.Header.Set("X-Forum-Signature", "sha256="+signWebhook(job.Secret, body))
+	req.SetBody(body)
+
+	err = webhookClient.DoTimeout(req, resp, webhookTimeout)
+	code := 0
+	if err == nil {
+		code = resp.StatusCode()
+		if code >= 200 && code < 300 {
+			err = MarkWebhookDelivered(ctx, job.ID, code)
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		err = fmt.Errorf("unexpected status code %d", code)
+	}
+
+	err = MarkWebhookFailed(ctx, job.ID, code, err.Error(), int(webhookBackoff(job.Attempts)/time.Second), webhookMaxAttempts)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 0; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// webhookIPs resolves host and fails unless every address it has is public,
+// so a name with one internal record cannot slip through.
+func webhookIPs(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	if WebhookAllowPrivate {
+		return ips, nil
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return nil, errWebhookAddress
+		}
+	}
+	return ips, nil
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialWebhook resolves the receiver again for every connection and dials the
+// checked address itself, so a DNS answer that changed after the webhook was
+// registered cannot turn deliveries towards the internal network.
+func dialWebhook(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	ips, err := webhookIPs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return fasthttp.DialTimeout(net.JoinHostPort(ips[0].String(), port), webhookTimeout)
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
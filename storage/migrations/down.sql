@@ -4,16 +4,55 @@ DROP TABLE IF EXISTS threads CASCADE;
 DROP TABLE IF EXISTS posts CASCADE;
 DROP TABLE IF EXISTS votes CASCADE;
 DROP TABLE IF EXISTS users_forum CASCADE;
+DROP TABLE IF EXISTS webhooks CASCADE;
+DROP TABLE IF EXISTS webhook_outbox CASCADE;
+DROP TABLE IF EXISTS events CASCADE;
+DROP TABLE IF EXISTS import_jobs CASCADE;
+DROP TABLE IF EXISTS import_errors CASCADE;
+DROP TABLE IF EXISTS import_users CASCADE;
+DROP TABLE IF EXISTS import_forums CASCADE;
+DROP TABLE IF EXISTS import_threads CASCADE;
+DROP TABLE IF EXISTS import_posts CASCADE;
+DROP TABLE IF EXISTS import_votes CASCADE;
+DROP TABLE IF EXISTS idempotency_keys CASCADE;
+DROP TABLE IF EXISTS rate_limits CASCADE;
+DROP TABLE IF EXISTS counters CASCADE;
+DROP TABLE IF EXISTS thread_trending CASCADE;
 
 DROP FUNCTION IF EXISTS update_path();
 DROP FUNCTION IF EXISTS update_threads_count();
 DROP FUNCTION IF EXISTS insert_votes();
 DROP FUNCTION IF EXISTS update_votes();
 DROP FUNCTION IF EXISTS update_user_forum();
+DROP FUNCTION IF EXISTS sync_user_forum();
+DROP FUNCTION IF EXISTS touch_thread_posts();
+DROP FUNCTION IF EXISTS bump_version();
+DROP FUNCTION IF EXISTS touch_updated();
+DROP FUNCTION IF EXISTS count_rows();
+DROP FUNCTION IF EXISTS count_posts();
 
 DROP TRIGGER IF EXISTS path_update_trigger ON posts;
+DROP TRIGGER IF EXISTS posts_insert_thread_counts ON posts;
 DROP TRIGGER IF EXISTS add_thread_to_forum ON threads;
 DROP TRIGGER IF EXISTS insert_votes ON votes;
 DROP TRIGGER IF EXISTS update_votes ON votes;
 DROP TRIGGER IF EXISTS thread_insert_user_forum ON threads;
-DROP TRIGGER IF EXISTS post_insert_user_forum ON posts;
\ No newline at end of file
+DROP TRIGGER IF EXISTS post_insert_user_forum ON posts;
+DROP TRIGGER IF EXISTS user_profile_user_forum ON users;
+DROP TRIGGER IF EXISTS post_edit_thread ON posts;
+DROP TRIGGER IF EXISTS user_version_trigger ON users;
+DROP TRIGGER IF EXISTS forum_version_trigger ON forums;
+DROP TRIGGER IF EXISTS thread_version_trigger ON threads;
+DROP TRIGGER IF EXISTS post_version_trigger ON posts;
+DROP TRIGGER IF EXISTS user_updated_trigger ON users;
+DROP TRIGGER IF EXISTS forum_updated_trigger ON forums;
+DROP TRIGGER IF EXISTS thread_updated_trigger ON threads;
+DROP TRIGGER IF EXISTS post_updated_trigger ON posts;
+DROP TRIGGER IF EXISTS users_insert_count ON users;
+DROP TRIGGER IF EXISTS users_delete_count ON users;
+DROP TRIGGER IF EXISTS forums_insert_count ON forums;
+DROP TRIGGER IF EXISTS forums_delete_count ON forums;
+DROP TRIGGER IF EXISTS threads_insert_count ON threads;
+DROP TRIGGER IF EXISTS threads_delete_count ON threads;
+DROP TRIGGER IF EXISTS posts_insert_count ON posts;
+DROP TRIGGER IF EXISTS posts_delete_count ON posts;
\ No newline at end of file
@@ -0,0 +1,319 @@
+-- Durable schema profile.
+--
+-- up.sql alone is the "benchmark" profile: every table is UNLOGGED, so a
+-- Postgres crash truncates all forum data. Running this script after up.sql
+-- gives the "durable" profile. It is also the migration path for an existing
+-- benchmark database, online, and can be re-run safely if it is interrupted:
+--
+--   psql -v ON_ERROR_STOP=1 -d forum_db -f durable.sql
+--
+-- ALTER TABLE ... SET LOGGED would rewrite each table under an ACCESS
+-- EXCLUSIVE lock for as long as the copy takes, so the tables are converted
+-- the way online schema changes usually are:
+--
+--   1. Every table gets a logged shadow, <table>_durable, with the same
+--      columns and indexes plus the durable constraints. Triggers on the
+--      table mirror each insert, update, delete and truncate into it. They
+--      are ENABLE ALWAYS, so they fire during an import merge too, which
+--      runs with session_replication_role = replica.
+--   2. The existing rows are copied in batches of 10000, each committed on
+--      its own. A batch reads its rows FOR SHARE: a concurrent edit of one
+--      of them waits for the batch, then mirrors over it, instead of racing
+--      the copy.
+--   3. One transaction locks every table and swaps the shadows in: it moves
+--      the triggers and sequences over, renames tables and indexes and adds
+--      the foreign keys NOT VALID. All of that is catalog work, so the lock
+--      is short whatever the size of the data. lock_timeout makes the swap
+--      give up instead of stalling requests behind a long transaction; just
+--      run the script again.
+--   4. The foreign keys are validated while writes continue, and the old
+--      unlogged tables are dropped.
+--
+-- Until the swap, every write is done twice and the copy is WAL-logged, so
+-- expect slower writes and make room on disk for a second copy of the data
+-- and its WAL. A mirrored write that breaks a durable constraint (a NULL or
+-- out of range vote) fails, as it will after the conversion. Grants are not
+-- copied: the server's role must own the tables, as the Dockerfile's does.
+--
+-- The import_* tables stay UNLOGGED on purpose: they only hold an import that
+-- has not been merged yet, and a crash resets a job together with its staged
+-- rows, so it simply starts over. rate_limits only holds counters for the
+-- current window, so it stays UNLOGGED as well.
+
+SET lock_timeout = '5s';
+
+-- durable_mirror replays a change of its table on the shadow named by its
+-- first argument. Its second argument lists the columns of a unique key.
+-- Every change deletes the old key and writes the new row, so a row that is
+-- already there, copied or mirrored, is simply replaced.
+CREATE OR REPLACE FUNCTION durable_mirror() RETURNS TRIGGER AS
+$durable_mirror$
+BEGIN
+    IF TG_OP = 'TRUNCATE' THEN
+        EXECUTE format('TRUNCATE %I', TG_ARGV[0]);
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        EXECUTE format('DELETE FROM %I WHERE (%s) = (SELECT %s FROM (SELECT ($1).*) o)',
+            TG_ARGV[0], TG_ARGV[1], TG_ARGV[1]) USING OLD;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        EXECUTE format('INSERT INTO %I SELECT ($1).*', TG_ARGV[0]) USING NEW;
+    END IF;
+    RETURN NULL;
+end
+$durable_mirror$ LANGUAGE plpgsql;
+
+-- durable_prepare creates the shadow of source with its indexes, applies
+-- constraints, a list of ALTER TABLE actions, to it while it is still empty
+-- and starts mirroring. It does nothing for a table that is already logged
+-- or already has its shadow.
+CREATE OR REPLACE FUNCTION durable_prepare(source TEXT, keys TEXT, constraints TEXT) RETURNS VOID AS
+$durable_prepare$
+DECLARE
+    shadow TEXT := source || '_durable';
+    idx    RECORD;
+BEGIN
+    IF (SELECT relpersistence FROM pg_class WHERE oid = source::regclass) = 'p'
+        OR to_regclass(shadow) IS NOT NULL THEN
+        RETURN;
+    END IF;
+
+    EXECUTE format('CREATE TABLE %I (LIKE %I INCLUDING DEFAULTS INCLUDING CONSTRAINTS INCLUDING STORAGE)',
+        shadow, source);
+    IF constraints <> '' THEN
+        EXECUTE format('ALTER TABLE %I %s', shadow, constraints);
+    END IF;
+
+    -- Indexes are built now, while the shadow is empty, under a durable_
+    -- prefix that the swap takes off again.
+    FOR idx IN
+        SELECT i.relname, x.indisunique, c.contype, pg_get_indexdef(x.indexrelid) AS def
+        FROM pg_index x
+            JOIN pg_class i ON i.oid = x.indexrelid
+            LEFT JOIN pg_constraint c ON c.conindid = x.indexrelid AND c.conrelid = x.indrelid
+        WHERE x.indrelid = source::regclass
+    LOOP
+        EXECUTE format('CREATE %sINDEX %I ON %I %s', CASE WHEN idx.indisunique THEN 'UNIQUE ' ELSE '' END,
+            'durable_' || idx.relname, shadow, substring(idx.def FROM 'USING .*$'));
+        IF idx.contype = 'p' THEN
+            EXECUTE format('ALTER TABLE %I ADD CONSTRAINT %I PRIMARY KEY USING INDEX %I',
+                shadow, 'durable_' || idx.relname, 'durable_' || idx.relname);
+        ELSIF idx.contype = 'u' THEN
+            EXECUTE format('ALTER TABLE %I ADD CONSTRAINT %I UNIQUE USING INDEX %I',
+                shadow, 'durable_' || idx.relname, 'durable_' || idx.relname);
+        END IF;
+    END LOOP;
+
+    EXECUTE format('CREATE TRIGGER durable_mirror AFTER INSERT OR UPDATE OR DELETE ON %I
+        FOR EACH ROW EXECUTE PROCEDURE durable_mirror(%L, %L)', source, shadow, keys);
+    EXECUTE format('CREATE TRIGGER durable_mirror_truncate AFTER TRUNCATE ON %I
+        FOR EACH STATEMENT EXECUTE PROCEDURE durable_mirror(%L, %L)', source, shadow, keys);
+    EXECUTE format('ALTER TABLE %I ENABLE ALWAYS TRIGGER durable_mirror, ENABLE ALWAYS TRIGGER durable_mirror_truncate',
+        source);
+end
+$durable_prepare$ LANGUAGE plpgsql;
+
+-- durable_copy copies the rows of source into its shadow in batches ordered by
+-- batch_column, which should lead an index. Rows mirrored in the meantime win
+-- over the copy, which only fills in what is missing.
+CREATE OR REPLACE PROCEDURE durable_copy(source TEXT, batch_column TEXT) AS
+$durable_copy$
+DECLARE
+    shadow      TEXT := source || '_durable';
+    column_type TEXT;
+    done        TEXT;
+    upto        TEXT;
+BEGIN
+    IF to_regclass(shadow) IS NULL THEN
+        RETURN;
+    END IF;
+
+    SELECT format_type(atttypid, atttypmod) FROM pg_attribute
+    WHERE attrelid = source::regclass AND attname = batch_column
+    INTO column_type;
+
+    LOOP
+        EXECUTE format('SELECT max(%1$I)::text FROM (SELECT %1$I FROM %2$I
+            WHERE $1 IS NULL OR %1$I > $1::%3$s ORDER BY %1$I LIMIT 10000) batch',
+            batch_column, source, column_type)
+            INTO upto USING done;
+        EXIT WHEN upto IS NULL;
+
+        EXECUTE format('INSERT INTO %3$I SELECT * FROM (SELECT * FROM %2$I
+            WHERE ($1 IS NULL OR %1$I > $1::%4$s) AND %1$I <= $2::%4$s FOR SHARE) batch
+            ON CONFLICT DO NOTHING', batch_column, source, shadow, column_type)
+            USING done, upto;
+        done := upto;
+        COMMIT;
+    END LOOP;
+
+    -- Rows the batches cannot order. Where the shadow has the column NOT NULL
+    -- this fails, and the data has to be fixed before the conversion.
+    EXECUTE format('INSERT INTO %2$I SELECT * FROM (SELECT * FROM %1$I WHERE %3$I IS NULL FOR SHARE) batch
+        ON CONFLICT DO NOTHING', source, shadow, batch_column);
+    COMMIT;
+end
+$durable_copy$ LANGUAGE plpgsql;
+
+-- durable_swap puts the shadow of source in its place. The caller holds an
+-- ACCESS EXCLUSIVE lock on source, so nothing is written in between. The old
+-- table stays behind as <table>_unlogged, with unlogged_ in front of the
+-- names of its indexes.
+CREATE OR REPLACE FUNCTION durable_swap(source TEXT) RETURNS VOID AS
+$durable_swap$
+DECLARE
+    shadow    TEXT := source || '_durable';
+    old       TEXT := source || '_unlogged';
+    namespace TEXT;
+    item      RECORD;
+BEGIN
+    IF to_regclass(shadow) IS NULL THEN
+        RETURN;
+    END IF;
+
+    EXECUTE format('DROP TRIGGER durable_mirror ON %I', source);
+    EXECUTE format('DROP TRIGGER durable_mirror_truncate ON %I', source);
+
+    SELECT n.nspname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE c.oid = source::regclass
+    INTO namespace;
+
+    FOR item IN
+        SELECT pg_get_triggerdef(oid) AS def FROM pg_trigger WHERE tgrelid = source::regclass AND NOT tgisinternal
+    LOOP
+        EXECUTE replace(item.def, format(' ON %I.%I ', namespace, source), format(' ON %I.%I ', namespace, shadow));
+    END LOOP;
+
+    FOR item IN
+        SELECT attname, pg_get_serial_sequence(format('%I.%I', namespace, source), attname) AS seq
+        FROM pg_attribute WHERE attrelid = source::regclass AND attnum > 0 AND NOT attisdropped
+    LOOP
+        IF item.seq IS NOT NULL THEN
+            EXECUTE format('ALTER SEQUENCE %s OWNED BY %I.%I', item.seq, shadow, item.attname);
+        END IF;
+    END LOOP;
+
+    EXECUTE format('ALTER TABLE %I RENAME TO %I', source, old);
+    FOR item IN
+        SELECT i.relname FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid WHERE x.indrelid = old::regclass
+    LOOP
+        EXECUTE format('ALTER INDEX %I RENAME TO %I', item.relname, 'unlogged_' || item.relname);
+    END LOOP;
+
+    EXECUTE format('ALTER TABLE %I RENAME TO %I', shadow, source);
+    FOR item IN
+        SELECT i.relname FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid
+        WHERE x.indrelid = source::regclass AND i.relname LIKE 'durable\_%'
+    LOOP
+        EXECUTE format('ALTER INDEX %I RENAME TO %I', item.relname, substr(item.relname, 9));
+    END LOOP;
+end
+$durable_swap$ LANGUAGE plpgsql;
+
+-- 1. Shadows. votes gets no NULL columns and only +1/-1 voices, posts a
+-- thread on every post.
+SELECT durable_prepare('users', 'nickname', '');
+SELECT durable_prepare('forums', 'slug', '');
+SELECT durable_prepare('threads', 'id', '');
+SELECT durable_prepare('posts', 'id', 'ALTER COLUMN thread SET NOT NULL');
+SELECT durable_prepare('votes', 'nickname, thread',
+    'ALTER COLUMN nickname SET NOT NULL, ALTER COLUMN voice SET NOT NULL, ALTER COLUMN thread SET NOT NULL,
+     ADD CONSTRAINT votes_voice_check CHECK (voice IN (-1, 1))');
+SELECT durable_prepare('users_forum', 'nickname, slug', '');
+SELECT durable_prepare('webhooks', 'id', '');
+SELECT durable_prepare('webhook_outbox', 'id', '');
+SELECT durable_prepare('events', 'seq', '');
+SELECT durable_prepare('idempotency_keys', 'client, key, route', '');
+SELECT durable_prepare('counters', 'name, slot', '');
+-- Derived, but read replicas can only serve logged tables.
+SELECT durable_prepare('thread_trending', 'thread', '');
+
+-- 2. Copy.
+CALL durable_copy('users', 'nickname');
+CALL durable_copy('forums', 'slug');
+CALL durable_copy('threads', 'id');
+CALL durable_copy('posts', 'id');
+CALL durable_copy('votes', 'nickname');
+CALL durable_copy('users_forum', 'slug');
+CALL durable_copy('webhooks', 'id');
+CALL durable_copy('webhook_outbox', 'id');
+CALL durable_copy('events', 'seq');
+CALL durable_copy('idempotency_keys', 'client');
+CALL durable_copy('counters', 'name');
+CALL durable_copy('thread_trending', 'thread');
+
+-- 3. Swap, under one short lock. ON DELETE behaviour: removing a forum or
+-- thread removes what hangs off it, while users that still own content
+-- cannot be deleted.
+BEGIN;
+LOCK TABLE users, forums, threads, posts, votes, users_forum, webhooks, webhook_outbox, events,
+    idempotency_keys, counters, thread_trending IN ACCESS EXCLUSIVE MODE;
+
+SELECT durable_swap('users');
+SELECT durable_swap('forums');
+SELECT durable_swap('threads');
+SELECT durable_swap('posts');
+SELECT durable_swap('votes');
+SELECT durable_swap('users_forum');
+SELECT durable_swap('webhooks');
+SELECT durable_swap('webhook_outbox');
+SELECT durable_swap('events');
+SELECT durable_swap('idempotency_keys');
+SELECT durable_swap('counters');
+SELECT durable_swap('thread_trending');
+
+ALTER TABLE forums DROP CONSTRAINT IF EXISTS forums_username_fkey,
+    ADD CONSTRAINT forums_username_fkey FOREIGN KEY (username) REFERENCES users (nickname) ON DELETE RESTRICT NOT VALID;
+ALTER TABLE threads DROP CONSTRAINT IF EXISTS threads_forum_fkey,
+    ADD CONSTRAINT threads_forum_fkey FOREIGN KEY (forum) REFERENCES forums (slug) ON DELETE CASCADE NOT VALID;
+ALTER TABLE threads DROP CONSTRAINT IF EXISTS threads_author_fkey,
+    ADD CONSTRAINT threads_author_fkey FOREIGN KEY (author) REFERENCES users (nickname) ON DELETE RESTRICT NOT VALID;
+ALTER TABLE posts DROP CONSTRAINT IF EXISTS posts_thread_fkey,
+    ADD CONSTRAINT posts_thread_fkey FOREIGN KEY (thread) REFERENCES threads (id) ON DELETE CASCADE NOT VALID;
+ALTER TABLE posts DROP CONSTRAINT IF EXISTS posts_forum_fkey,
+    ADD CONSTRAINT posts_forum_fkey FOREIGN KEY (forum) REFERENCES forums (slug) ON DELETE CASCADE NOT VALID;
+ALTER TABLE posts DROP CONSTRAINT IF EXISTS posts_parent_fkey,
+    ADD CONSTRAINT posts_parent_fkey FOREIGN KEY (parent) REFERENCES posts (id) ON DELETE CASCADE NOT VALID;
+ALTER TABLE posts DROP CONSTRAINT IF EXISTS posts_author_fkey,
+    ADD CONSTRAINT posts_author_fkey FOREIGN KEY (author) REFERENCES users (nickname) ON DELETE RESTRICT NOT VALID;
+ALTER TABLE votes DROP CONSTRAINT IF EXISTS votes_thread_fkey,
+    ADD CONSTRAINT votes_thread_fkey FOREIGN KEY (thread) REFERENCES threads (id) ON DELETE CASCADE NOT VALID;
+ALTER TABLE votes DROP CONSTRAINT IF EXISTS votes_nickname_fkey,
+    ADD CONSTRAINT votes_nickname_fkey FOREIGN KEY (nickname) REFERENCES users (nickname) ON DELETE CASCADE NOT VALID;
+ALTER TABLE users_forum DROP CONSTRAINT IF EXISTS users_forum_nickname_fkey,
+    ADD CONSTRAINT users_forum_nickname_fkey FOREIGN KEY (nickname) REFERENCES users (nickname) ON DELETE CASCADE NOT VALID;
+ALTER TABLE users_forum DROP CONSTRAINT IF EXISTS users_forum_slug_fkey,
+    ADD CONSTRAINT users_forum_slug_fkey FOREIGN KEY (slug) REFERENCES forums (slug) ON DELETE CASCADE NOT VALID;
+ALTER TABLE webhooks DROP CONSTRAINT IF EXISTS webhooks_forum_fkey,
+    ADD CONSTRAINT webhooks_forum_fkey FOREIGN KEY (forum) REFERENCES forums (slug) ON DELETE CASCADE NOT VALID;
+ALTER TABLE webhook_outbox DROP CONSTRAINT IF EXISTS webhook_outbox_webhook_fkey,
+    ADD CONSTRAINT webhook_outbox_webhook_fkey FOREIGN KEY (webhook) REFERENCES webhooks (id) ON DELETE CASCADE NOT VALID;
+COMMIT;
+
+-- 4. Validation only takes locks that let reads and writes go on.
+ALTER TABLE forums VALIDATE CONSTRAINT forums_username_fkey;
+ALTER TABLE threads VALIDATE CONSTRAINT threads_forum_fkey;
+ALTER TABLE threads VALIDATE CONSTRAINT threads_author_fkey;
+ALTER TABLE posts VALIDATE CONSTRAINT posts_thread_fkey;
+ALTER TABLE posts VALIDATE CONSTRAINT posts_forum_fkey;
+ALTER TABLE posts VALIDATE CONSTRAINT posts_parent_fkey;
+ALTER TABLE posts VALIDATE CONSTRAINT posts_author_fkey;
+ALTER TABLE votes VALIDATE CONSTRAINT votes_thread_fkey;
+ALTER TABLE votes VALIDATE CONSTRAINT votes_nickname_fkey;
+ALTER TABLE users_forum VALIDATE CONSTRAINT users_forum_nickname_fkey;
+ALTER TABLE users_forum VALIDATE CONSTRAINT users_forum_slug_fkey;
+ALTER TABLE webhooks VALIDATE CONSTRAINT webhooks_forum_fkey;
+ALTER TABLE webhook_outbox VALIDATE CONSTRAINT webhook_outbox_webhook_fkey;
+
+-- Nothing reads the old tables any more, and their sequences now belong to
+-- the new ones.
+DROP TABLE IF EXISTS users_unlogged, forums_unlogged, threads_unlogged, posts_unlogged, votes_unlogged,
+    users_forum_unlogged, webhooks_unlogged, webhook_outbox_unlogged, events_unlogged,
+    idempotency_keys_unlogged, counters_unlogged, thread_trending_unlogged CASCADE;
+
+DROP FUNCTION IF EXISTS durable_swap(TEXT);
+DROP PROCEDURE IF EXISTS durable_copy(TEXT, TEXT);
+DROP FUNCTION IF EXISTS durable_prepare(TEXT, TEXT, TEXT);
+DROP FUNCTION IF EXISTS durable_mirror();
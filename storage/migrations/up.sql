@@ -1,10 +1,13 @@
 CREATE EXTENSION IF NOT EXISTS citext;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
 
 CREATE UNLOGGED TABLE "users" (
   "about" TEXT,
   "email" CITEXT UNIQUE,
   "fullname" TEXT NOT NULL,
-  "nickname" CITEXT PRIMARY KEY
+  "nickname" CITEXT PRIMARY KEY,
+  "version" BIGINT DEFAULT 1,
+  "updated" timestamp with time zone default now()
 );
 
 CREATE UNLOGGED TABLE "forums" (
@@ -13,6 +16,9 @@ CREATE UNLOGGED TABLE "forums" (
   "threads" int DEFAULT 0,
   "slug" CITEXT PRIMARY KEY,
   "title" TEXT NOT NULL,
+  "version" BIGINT DEFAULT 1,
+  "updated" timestamp with time zone default now(),
+  "last_activity" timestamp with time zone NOT NULL default now(),
   FOREIGN KEY ("username") REFERENCES "users" (nickname)
 );
 
@@ -25,6 +31,11 @@ CREATE UNLOGGED TABLE "threads" (
   "slug" CITEXT UNIQUE,
   "title" TEXT NOT NULL,
   "votes" int DEFAULT 0,
+  "posts" int NOT NULL DEFAULT 0,
+  "last_post_at" timestamp with time zone NOT NULL default now(),
+  "posts_edited" timestamp with time zone NOT NULL default now(),
+  "version" BIGINT DEFAULT 1,
+  "updated" timestamp with time zone default now(),
   FOREIGN KEY (author) REFERENCES "users" (nickname),
   FOREIGN KEY (forum) REFERENCES "forums" (slug)
 );
@@ -39,6 +50,8 @@ CREATE UNLOGGED TABLE "posts" (
   "parent" BIGINT DEFAULT 0,
   "thread" int,
   "path" BIGINT[] DEFAULT ARRAY []::INTEGER[],
+  "version" BIGINT DEFAULT 1,
+  "updated" timestamp with time zone default now(),
   
   FOREIGN KEY (author) REFERENCES "users" (nickname),
   FOREIGN KEY (forum) REFERENCES "forums" (slug),
@@ -67,10 +80,172 @@ CREATE UNLOGGED TABLE "users_forum" (
     UNIQUE (nickname, slug)
 );
 
+CREATE UNLOGGED TABLE "webhooks" (
+    "id" SERIAL PRIMARY KEY,
+    "forum" CITEXT NOT NULL,
+    "url" TEXT NOT NULL,
+    "secret" TEXT NOT NULL,
+    "events" TEXT[] NOT NULL DEFAULT ARRAY []::TEXT[],
+    "created" timestamp with time zone default now(),
+    FOREIGN KEY (forum) REFERENCES "forums" (slug)
+);
+
+CREATE UNLOGGED TABLE "webhook_outbox" (
+    "id" BIGSERIAL PRIMARY KEY,
+    "webhook" int NOT NULL,
+    "event" TEXT NOT NULL,
+    "payload" JSONB NOT NULL,
+    "status" TEXT NOT NULL DEFAULT 'pending',
+    "attempts" int DEFAULT 0,
+    "next_attempt" timestamp with time zone default now(),
+    "last_error" TEXT,
+    "response_code" int,
+    "created" timestamp with time zone default now(),
+    "delivered" timestamp with time zone,
+    FOREIGN KEY (webhook) REFERENCES "webhooks" (id) ON DELETE CASCADE
+);
+
+CREATE UNLOGGED TABLE "events" (
+    "seq" BIGSERIAL PRIMARY KEY,
+    "xid" BIGINT NOT NULL DEFAULT txid_current(),
+    "type" TEXT NOT NULL,
+    "entity" TEXT NOT NULL,
+    "payload" JSONB NOT NULL,
+    "created" timestamp with time zone default now()
+);
+
+CREATE UNLOGGED TABLE "import_jobs" (
+    "id" TEXT PRIMARY KEY,
+    "status" TEXT NOT NULL DEFAULT 'staging',
+    "lines" BIGINT DEFAULT 0,
+    "users" int DEFAULT 0,
+    "forums" int DEFAULT 0,
+    "threads" int DEFAULT 0,
+    "posts" int DEFAULT 0,
+    "created" timestamp with time zone default now(),
+    "updated" timestamp with time zone default now()
+);
+
+CREATE UNLOGGED TABLE "import_errors" (
+    "job" TEXT NOT NULL,
+    "line" BIGINT NOT NULL,
+    "message" TEXT NOT NULL
+);
+
+CREATE UNLOGGED TABLE "import_users" (
+    "job" TEXT NOT NULL,
+    "line" BIGINT NOT NULL,
+    "about" TEXT,
+    "email" CITEXT,
+    "fullname" TEXT,
+    "nickname" CITEXT,
+    "error" TEXT,
+    PRIMARY KEY (job, line)
+);
+
+CREATE UNLOGGED TABLE "import_forums" (
+    "job" TEXT NOT NULL,
+    "line" BIGINT NOT NULL,
+    "slug" CITEXT,
+    "title" TEXT,
+    "username" CITEXT,
+    "error" TEXT,
+    PRIMARY KEY (job, line)
+);
+
+CREATE UNLOGGED TABLE "import_threads" (
+    "job" TEXT NOT NULL,
+    "line" BIGINT NOT NULL,
+    "src_id" BIGINT,
+    "author" CITEXT,
+    "created" timestamp with time zone,
+    "forum" CITEXT,
+    "message" TEXT,
+    "slug" CITEXT,
+    "title" TEXT,
+    "votes" int,
+    "id" int,
+    "error" TEXT,
+    PRIMARY KEY (job, line)
+);
+
+CREATE UNLOGGED TABLE "import_posts" (
+    "job" TEXT NOT NULL,
+    "line" BIGINT NOT NULL,
+    "src_id" BIGINT,
+    "author" CITEXT,
+    "created" timestamp with time zone,
+    "is_edited" BOOLEAN,
+    "message" TEXT,
+    "parent" BIGINT,
+    "thread" BIGINT,
+    "id" BIGINT,
+    "path" BIGINT[],
+    "error" TEXT,
+    PRIMARY KEY (job, line)
+);
+
+CREATE UNLOGGED TABLE "import_votes" (
+    "job" TEXT NOT NULL,
+    "line" BIGINT NOT NULL,
+    "nickname" CITEXT,
+    "voice" int,
+    "thread" BIGINT,
+    "error" TEXT,
+    PRIMARY KEY (job, line)
+);
+
+-- Response snapshots for retried create requests. status stays NULL while the
+-- first request is still running; locked_until lets another attempt take over
+-- if that request never finishes.
+CREATE UNLOGGED TABLE "idempotency_keys" (
+    "client" TEXT NOT NULL,
+    "key" TEXT NOT NULL,
+    "route" TEXT NOT NULL,
+    "request_hash" TEXT NOT NULL,
+    "status" int,
+    "content_type" TEXT,
+    "body" TEXT,
+    "locked_until" timestamp with time zone NOT NULL,
+    "created" timestamp with time zone default now(),
+    "expires" timestamp with time zone NOT NULL,
+    PRIMARY KEY (client, key, route)
+);
+
+-- Fixed-window request counters shared by every instance when the rate
+-- limiter runs with -rate-limit-shared.
+CREATE UNLOGGED TABLE "rate_limits" (
+    "key" TEXT NOT NULL,
+    "expires" timestamp with time zone NOT NULL,
+    "count" int NOT NULL DEFAULT 1,
+    PRIMARY KEY (key, expires)
+);
+
+-- Row counts of users, forums, threads and posts for /api/service/status,
+-- kept by the count_rows triggers. Each backend adds to its own slot so that
+-- concurrent writers do not queue on one row; the status query sums them.
+CREATE UNLOGGED TABLE "counters" (
+    "name" TEXT NOT NULL,
+    "slot" int NOT NULL,
+    "value" BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (name, slot)
+);
+
+-- Trending scores of recently active threads, rebuilt by the trending
+-- refresher so that reads only have to walk an index.
+CREATE UNLOGGED TABLE "thread_trending" (
+    "thread" int PRIMARY KEY,
+    "forum" CITEXT NOT NULL,
+    "score" double precision NOT NULL,
+    "computed" timestamp with time zone NOT NULL default now()
+);
+
 CREATE OR REPLACE FUNCTION update_threads_count() RETURNS TRIGGER AS
 $update_users_forum$
 BEGIN
-    UPDATE forums SET Threads=(Threads+1) WHERE LOWER(slug)=LOWER(NEW.forum);
+    UPDATE forums SET Threads=(Threads+1), last_activity=now() WHERE LOWER(slug)=LOWER(NEW.forum);
+    -- A thread without replies is as active as it is old.
+    NEW.last_post_at := NEW.created;
     return NEW;
 end
 $update_users_forum$ LANGUAGE plpgsql;
@@ -92,7 +267,6 @@ BEGIN
 
         NEW.path := NEW.path || parent_path || new.id;
     end if;
-    UPDATE forums SET Posts=Posts + 1 WHERE lower(forums.slug) = lower(new.forum);
     RETURN new;
 end
 $update_path$ LANGUAGE plpgsql;
@@ -109,7 +283,7 @@ CREATE OR REPLACE FUNCTION update_votes() RETURNS TRIGGER AS
 $update_users_forum$
 begin
 	IF OLD.voice <> NEW.voice THEN
-    	UPDATE threads SET votes=(votes+NEW.voice*2) WHERE id=NEW.thread;
+    	UPDATE threads SET votes=(votes+NEW.voice-OLD.voice) WHERE id=NEW.thread;
     END IF;
     return NEW;
 end
@@ -129,6 +303,85 @@ BEGIN
 end
 $update_users_forum$ LANGUAGE plpgsql;
 
+-- users_forum keeps a copy of the profile, so edits have to reach it too.
+CREATE OR REPLACE FUNCTION sync_user_forum() RETURNS TRIGGER AS
+$sync_user_forum$
+BEGIN
+    UPDATE users_forum SET fullname = NEW.fullname, about = NEW.about, email = NEW.email
+    WHERE nickname = NEW.nickname;
+    return NEW;
+end
+$sync_user_forum$ LANGUAGE plpgsql;
+
+-- An edit changes a page of the thread's posts without moving its post count
+-- or last post, so the thread records it for the ETag of its post listing.
+CREATE OR REPLACE FUNCTION touch_thread_posts() RETURNS TRIGGER AS
+$touch_thread_posts$
+BEGIN
+    UPDATE threads SET posts_edited = now() WHERE id = NEW.thread;
+    return NEW;
+end
+$touch_thread_posts$ LANGUAGE plpgsql;
+
+-- updated backs Last-Modified, so it moves with every change, the counters
+-- kept by the triggers above included.
+CREATE OR REPLACE FUNCTION touch_updated() RETURNS TRIGGER AS
+$touch_updated$
+BEGIN
+    IF NEW IS DISTINCT FROM OLD THEN
+        NEW.updated := now();
+    END IF;
+    return NEW;
+end
+$touch_updated$ LANGUAGE plpgsql;
+
+-- version is what If-Match and the version field of an edit are checked
+-- against. The version triggers only fire when a column clients edit
+-- changes, so a vote or a new post does not fail an edit in flight.
+CREATE OR REPLACE FUNCTION bump_version() RETURNS TRIGGER AS
+$bump_version$
+BEGIN
+    NEW.version := OLD.version + 1;
+    return NEW;
+end
+$bump_version$ LANGUAGE plpgsql;
+
+-- Statement-level, so a batch insert touches its counter once.
+CREATE OR REPLACE FUNCTION count_rows() RETURNS TRIGGER AS
+$count_rows$
+DECLARE
+    delta BIGINT;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        SELECT COUNT(*) FROM new_rows INTO delta;
+    ELSE
+        SELECT -COUNT(*) FROM old_rows INTO delta;
+    END IF;
+
+    IF delta <> 0 THEN
+        INSERT INTO counters (name, slot, value) VALUES (TG_TABLE_NAME, pg_backend_pid() % 16, delta)
+        ON CONFLICT (name, slot) DO UPDATE SET value = counters.value + EXCLUDED.value;
+    END IF;
+    return NULL;
+end
+$count_rows$ LANGUAGE plpgsql;
+
+-- Statement-level too: a batch of posts updates each of its threads and
+-- forums once, instead of once per post.
+CREATE OR REPLACE FUNCTION count_posts() RETURNS TRIGGER AS
+$count_posts$
+BEGIN
+    UPDATE threads t SET posts = t.posts + n.posts, last_post_at = GREATEST(t.last_post_at, n.last_post_at)
+    FROM (SELECT thread, COUNT(*) AS posts, MAX(created) AS last_post_at FROM new_rows GROUP BY thread) n
+    WHERE t.id = n.thread;
+
+    UPDATE forums f SET posts = f.posts + n.posts, last_activity = now()
+    FROM (SELECT lower(forum) AS forum, COUNT(*) AS posts FROM new_rows GROUP BY lower(forum)) n
+    WHERE lower(f.slug) = n.forum;
+    return NULL;
+end
+$count_posts$ LANGUAGE plpgsql;
+
 CREATE TRIGGER add_thread_to_forum
     BEFORE INSERT
     ON threads
@@ -141,6 +394,13 @@ CREATE TRIGGER path_update_trigger
     FOR EACH ROW
 EXECUTE PROCEDURE update_path();
 
+CREATE TRIGGER posts_insert_thread_counts
+    AFTER INSERT
+    ON posts
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_posts();
+
 CREATE TRIGGER add_vote
     BEFORE INSERT
     ON votes
@@ -165,24 +425,181 @@ CREATE TRIGGER post_insert_user_forum
     FOR EACH ROW
 EXECUTE PROCEDURE update_user_forum();
 
+CREATE TRIGGER user_profile_user_forum
+    AFTER UPDATE OF fullname, about, email
+    ON users
+    FOR EACH ROW
+    WHEN ((OLD.fullname, OLD.about, OLD.email) IS DISTINCT FROM (NEW.fullname, NEW.about, NEW.email))
+EXECUTE PROCEDURE sync_user_forum();
+
+CREATE TRIGGER post_edit_thread
+    AFTER UPDATE OF message
+    ON posts
+    FOR EACH ROW
+    WHEN (OLD.message IS DISTINCT FROM NEW.message)
+EXECUTE PROCEDURE touch_thread_posts();
+
+CREATE TRIGGER user_version_trigger
+    BEFORE UPDATE
+    ON users
+    FOR EACH ROW
+    WHEN ((OLD.about, OLD.email, OLD.fullname) IS DISTINCT FROM (NEW.about, NEW.email, NEW.fullname))
+EXECUTE PROCEDURE bump_version();
+
+CREATE TRIGGER forum_version_trigger
+    BEFORE UPDATE
+    ON forums
+    FOR EACH ROW
+    WHEN ((OLD.slug, OLD.title, OLD.username) IS DISTINCT FROM (NEW.slug, NEW.title, NEW.username))
+EXECUTE PROCEDURE bump_version();
+
+CREATE TRIGGER thread_version_trigger
+    BEFORE UPDATE
+    ON threads
+    FOR EACH ROW
+    WHEN ((OLD.author, OLD.created, OLD.forum, OLD.message, OLD.slug, OLD.title)
+        IS DISTINCT FROM (NEW.author, NEW.created, NEW.forum, NEW.message, NEW.slug, NEW.title))
+EXECUTE PROCEDURE bump_version();
+
+CREATE TRIGGER post_version_trigger
+    BEFORE UPDATE
+    ON posts
+    FOR EACH ROW
+    WHEN ((OLD.author, OLD.created, OLD.forum, OLD.is_edited, OLD.message, OLD.parent, OLD.thread)
+        IS DISTINCT FROM (NEW.author, NEW.created, NEW.forum, NEW.is_edited, NEW.message, NEW.parent, NEW.thread))
+EXECUTE PROCEDURE bump_version();
+
+CREATE TRIGGER user_updated_trigger
+    BEFORE UPDATE
+    ON users
+    FOR EACH ROW
+EXECUTE PROCEDURE touch_updated();
+
+CREATE TRIGGER forum_updated_trigger
+    BEFORE UPDATE
+    ON forums
+    FOR EACH ROW
+EXECUTE PROCEDURE touch_updated();
+
+CREATE TRIGGER thread_updated_trigger
+    BEFORE UPDATE
+    ON threads
+    FOR EACH ROW
+EXECUTE PROCEDURE touch_updated();
+
+CREATE TRIGGER post_updated_trigger
+    BEFORE UPDATE
+    ON posts
+    FOR EACH ROW
+EXECUTE PROCEDURE touch_updated();
+
+CREATE TRIGGER users_insert_count
+    AFTER INSERT
+    ON users
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
+CREATE TRIGGER users_delete_count
+    AFTER DELETE
+    ON users
+    REFERENCING OLD TABLE AS old_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
+CREATE TRIGGER forums_insert_count
+    AFTER INSERT
+    ON forums
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
+CREATE TRIGGER forums_delete_count
+    AFTER DELETE
+    ON forums
+    REFERENCING OLD TABLE AS old_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
+CREATE TRIGGER threads_insert_count
+    AFTER INSERT
+    ON threads
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
+CREATE TRIGGER threads_delete_count
+    AFTER DELETE
+    ON threads
+    REFERENCING OLD TABLE AS old_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
+CREATE TRIGGER posts_insert_count
+    AFTER INSERT
+    ON posts
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
+CREATE TRIGGER posts_delete_count
+    AFTER DELETE
+    ON posts
+    REFERENCING OLD TABLE AS old_rows
+    FOR EACH STATEMENT
+EXECUTE PROCEDURE count_rows();
+
 CREATE INDEX post_id_path1_index ON posts (id, (posts.path[1]));
 CREATE INDEX post_thread_id_path1_parent_index ON posts (thread, id, (posts.path[1]), parent);
 CREATE INDEX post_thread_path_id_index ON posts (thread, path, id);
 CREATE INDEX post_path1_index ON posts ((posts.path[1]));
 CREATE INDEX post_thread_id_index ON posts (thread, id);
 CREATE INDEX post_thread_index ON posts (thread);
+CREATE INDEX post_created_index ON posts (created);
+CREATE INDEX post_parent_id_index ON posts (parent, id);
+CREATE INDEX post_author_lower_created_index ON posts (lower(author), created, id);
 
 CREATE INDEX forum_slug_lower_index ON forums (lower(forums.Slug));
+-- The directory sorts by counters too, but those change on every post and an
+-- index on them would rule out HOT updates of the forums row; the forums table
+-- is small enough to sort.
+CREATE INDEX forum_title_slug_index ON forums (title, slug);
+CREATE INDEX forum_username_index ON forums (username);
 
 CREATE INDEX users_email_nickname_lower_index ON users (lower(users.email), lower(users.nickname));
 CREATE INDEX users_nickname_index ON users (lower(users.nickname));
+CREATE INDEX users_fullname_nickname_index ON users (fullname, nickname);
+CREATE INDEX users_nickname_trgm_index ON users USING gin ((nickname::text) gin_trgm_ops);
+CREATE INDEX users_fullname_trgm_index ON users USING gin (fullname gin_trgm_ops);
 
 CREATE UNIQUE INDEX forum_users_unique on users_forum (slug, nickname);
 cluster users_forum using forum_users_unique;
+CREATE INDEX users_forum_nickname_index ON users_forum (nickname);
 
 CREATE INDEX thread_forum_lower_index ON threads (lower(forum));
 CREATE INDEX thread_slug_index ON threads (lower(slug));
 CREATE INDEX thread_slug_id_index ON threads (lower(forum), created);
 CREATE INDEX thread_created_index ON threads (created);
+CREATE INDEX thread_forum_votes_index ON threads (lower(forum), votes, id);
+CREATE INDEX thread_forum_last_post_index ON threads (lower(forum), last_post_at, id);
+CREATE INDEX thread_forum_posts_index ON threads (lower(forum), posts, id);
+CREATE INDEX thread_author_lower_created_index ON threads (lower(author), created, id);
 
 CREATE INDEX vote_nickname ON votes (lower(nickname), thread);
+CREATE INDEX vote_thread_index ON votes (thread);
+
+CREATE INDEX webhook_forum_lower_index ON webhooks (lower(forum));
+CREATE INDEX webhook_outbox_pending_index ON webhook_outbox (next_attempt) WHERE status = 'pending';
+CREATE INDEX webhook_outbox_webhook_index ON webhook_outbox (webhook, id);
+
+CREATE INDEX events_xid_seq_index ON events (xid, seq);
+
+CREATE INDEX import_errors_job_line_index ON import_errors (job, line);
+CREATE INDEX import_threads_job_src_id_index ON import_threads (job, src_id);
+CREATE INDEX import_posts_job_parent_index ON import_posts (job, parent);
+
+CREATE INDEX idempotency_keys_expires_index ON idempotency_keys (expires);
+CREATE INDEX rate_limits_expires_index ON rate_limits (expires);
+
+CREATE INDEX thread_trending_score_index ON thread_trending (score DESC, thread);
+CREATE INDEX thread_trending_forum_score_index ON thread_trending (lower(forum), score DESC, thread);